@@ -15,19 +15,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"runtime"
 
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
 	"github.com/dcos/dcos-cni/pkg/l4lb"
+	"github.com/dcos/dcos-cni/pkg/mesos"
 	"github.com/dcos/dcos-cni/pkg/minuteman"
 	"github.com/dcos/dcos-cni/pkg/spartan"
 
 	"github.com/containernetworking/cni/pkg/invoke"
-	"github.com/containernetworking/cni/pkg/ip"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+
+	"golang.org/x/sys/unix"
 )
 
 // By default Spartan and Minuteman are specified to be enabled.
@@ -39,39 +50,156 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func cmdAdd(args *skel.CmdArgs) error {
+// undoStack records how to revert each step of ADD that has completed,
+// so that a failure in a later step does not leak the state set up by the
+// earlier ones.
+type undoStack []func() error
+
+func (u *undoStack) push(undo func() error) {
+	*u = append(*u, undo)
+}
+
+// run reverts the recorded steps in the reverse order in which they were
+// set up. Failures are only logged, since we are already on an error path
+// and want to clean up as much as we can.
+func (u *undoStack) run() {
+	for i := len(*u) - 1; i >= 0; i-- {
+		if err := (*u)[i](); err != nil {
+			log.Printf("failed to roll back ADD: %s", err)
+		}
+	}
+
+	*u = nil
+}
+
+// delegateAdd invokes ADD on the delegate plugin, and records how to undo
+// it in case a later step of ADD fails.
+func delegateAdd(conf *l4lb.NetConf, undo *undoStack) (*current.Result, error) {
+	delegateConf, delegatePlugin, err := conf.SetupDelegateConf()
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to retrieve delegate configuration")
+	}
+
+	delegateResult, err := invoke.DelegateAdd(context.TODO(), delegatePlugin, delegateConf, nil)
+	if err != nil {
+		return nil, cnierrors.Delegate(err, fmt.Sprintf("failed to invoke delegate plugin %s", delegatePlugin))
+	}
+
+	undo.push(func() error {
+		return invoke.DelegateDel(context.TODO(), delegatePlugin, delegateConf, nil)
+	})
+
+	// Make sure that whatever the delegate returned can be handed back
+	// to the runtime in the version it asked for.
+	if _, err := l4lb.ConvertResult(delegateResult, conf.CNIVersion); err != nil {
+		return nil, err
+	}
+
+	result, err := current.NewResultFromResult(delegateResult)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrDelegateFailure, fmt.Sprintf("failed to parse result of delegate plugin %s", delegatePlugin))
+	}
+
+	return result, nil
+}
+
+// chainedResult returns the result of the previous plugin in the chain,
+// which has already set up the container's networking.
+func chainedResult(conf *l4lb.NetConf) (*current.Result, error) {
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to parse prevResult")
+	}
+
+	if conf.PrevResult == nil {
+		msg := "either a `delegate` network or a `prevResult` from a previous plugin in the chain is required"
+		return nil, cnierrors.New(cnierrors.ErrInvalidConfig, msg, "")
+	}
+
+	if _, err := l4lb.ConvertResult(conf.PrevResult, conf.CNIVersion); err != nil {
+		return nil, err
+	}
+
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to convert prevResult")
+	}
+
+	return result, nil
+}
+
+func cmdAdd(args *skel.CmdArgs) (err error) {
 	conf := l4lb.NewNetConf()
 
 	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %s", err)
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load netconf")
 	}
 
 	if err := ip.EnableIP4Forward(); err != nil {
-		return fmt.Errorf("failed to enable forwarding: %s", err)
+		return cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to enable forwarding")
 	}
 
-	delegateConf, delegatePlugin, err := conf.SetupDelegateConf()
-	if err != nil {
-		return fmt.Errorf("failed to retrieve delegate configuration: %s", err)
+	var undo undoStack
+	defer func() {
+		if err != nil {
+			log.Printf("ADD failed for container:%s, rolling back: %s", args.ContainerID, err)
+			undo.run()
+		}
+	}()
+
+	// The result we hand back starts off as the result of the delegate,
+	// or of the previous plugin in the chain, and is extended with every
+	// network we attach the container to.
+	var result *current.Result
+	var spartanResult *current.Result
+	var resolvConf string
+	if conf.Chained() {
+		result, err = chainedResult(conf)
+	} else {
+		result, err = delegateAdd(conf, &undo)
 	}
 
-	delegateResult, err := invoke.DelegateAdd(delegatePlugin, delegateConf)
 	if err != nil {
-		return fmt.Errorf("failed to invoke delegate plugin %s: %s", delegatePlugin, err)
+		return err
+	}
+
+	// Tell minuteman everything it might want to know about the
+	// container.
+	registration := &minuteman.Registration{
+		Network: conf.Name,
+		Labels:  mesos.Labels(conf.Args),
+	}
+	for _, ipc := range result.IPs {
+		registration.ContainerIPs = append(registration.ContainerIPs, ipc.Address.IP)
 	}
 
 	if conf.Spartan.Enable {
 		log.Println("Spartan enabled:", conf.Spartan)
 		// Install the spartan network.
-		err := spartan.CniAdd(args)
+		spartanResult, err = spartan.CniAdd(args, conf.Spartan, conf.Name, conf.MTU)
 		if err != nil {
-			return fmt.Errorf("failed: %s", err)
+			return cnierrors.Wrap(err, cnierrors.ErrInternal, fmt.Sprintf("failed to attach container:%s to the spartan network", args.ContainerID))
+		}
+
+		undo.push(func() error {
+			return spartan.CniDel(args, conf.Spartan, conf.Name)
+		})
+
+		l4lb.MergeResult(result, spartanResult)
+		for _, ipc := range spartanResult.IPs {
+			registration.SpartanIPs = append(registration.SpartanIPs, ipc.Address.IP)
 		}
 
-		//TODO(asridharan): We probably need to update the DNS result to
-		//make sure that we override the DNS resolution with the spartan
-		//network, since the operator has explicitly requested to use the
-		//spartan network.
+		// The operator has explicitly requested to use the spartan
+		// network, so point DNS resolution at spartan.
+		result.DNS = conf.Spartan.OverrideDNS(result.DNS)
+
+		// Not every container looks at the DNS section of the result,
+		// so hand the containerizer a resolv.conf to bind-mount as well.
+		// Rolling back the spartan network removes it again.
+		resolvConf, err = conf.Spartan.WriteResolvConf(args.ContainerID, result.DNS)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to write resolv.conf for container:%s", args.ContainerID))
+		}
 	}
 
 	// Check if minuteman needs to be enabled for this container.
@@ -82,63 +210,360 @@ func cmdAdd(args *skel.CmdArgs) error {
 		minutemanArgs := *args
 		minutemanArgs.StdinData, err = json.Marshal(conf.Minuteman)
 		if err != nil {
-			return fmt.Errorf("failed to marshal the minuteman configuration into STDIN for the minuteman plugin")
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshal the minuteman configuration into STDIN for the minuteman plugin")
 		}
 
-		err = minuteman.CniAdd(&minutemanArgs)
+		err = minuteman.CniAdd(&minutemanArgs, registration)
 		if err != nil {
-			return fmt.Errorf("failed to register container:%s with minuteman: %s", args.ContainerID, err)
+			return cnierrors.Wrap(err, cnierrors.ErrInternal, fmt.Sprintf("failed to register container:%s with minuteman", args.ContainerID))
 		}
+
+		undo.push(func() error {
+			return minuteman.CniDel(&minutemanArgs)
+		})
 	}
 
-	// We always return the result from the delegate plugin and not from
-	// this plugin.
-	return delegateResult.Print()
+	// Return the delegate's result merged with the spartan network,
+	// converted back to the version the runtime asked for.
+	finalResult, err := l4lb.ConvertMergedResult(result, spartanResult, conf.CNIVersion)
+	if err != nil {
+		return err
+	}
+
+	var extensions map[string]interface{}
+	if resolvConf != "" {
+		extensions = map[string]interface{}{l4lb.ResolvConfKey: resolvConf}
+	}
+
+	return l4lb.PrintResult(os.Stdout, finalResult, extensions)
 }
 
+// cmdDel detaches the container from the spartan network, de-registers
+// it from minuteman and invokes DEL on the delegate. DEL is best-effort:
+// every step runs even if an earlier one fails, so that a failure in one
+// does not leak what the others set up, and the first failure is
+// returned.
 func cmdDel(args *skel.CmdArgs) error {
 	conf := l4lb.NewNetConf()
 
 	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to load netconf: %s", err)
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load netconf")
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		log.Printf("DEL failed for container:%s: %s", args.ContainerID, err)
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
 
 	if conf.Spartan.Enable {
-		err := spartan.CniDel(args)
+		err := spartan.CniDel(args, conf.Spartan, conf.Name)
 		if err != nil {
-			return fmt.Errorf("failed to invoke the spartan plugin with CNI_DEL")
+			fail(cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to invoke the spartan plugin with CNI_DEL"))
 		}
 	}
 
 	if conf.Minuteman.Enable {
-		var err error
 		minutemanArgs := *args
 		// Check if minuteman entries need to be removed from this container.
-		minutemanArgs.StdinData, err = json.Marshal(conf.Minuteman)
+		stdinData, err := json.Marshal(conf.Minuteman)
 		if err != nil {
-			return fmt.Errorf("failed to marshal the minuteman configuration into STDIN for the minuteman plugin")
+			fail(cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshal the minuteman configuration into STDIN for the minuteman plugin"))
+		} else {
+			minutemanArgs.StdinData = stdinData
+			if err := minuteman.CniDel(&minutemanArgs); err != nil {
+				fail(cnierrors.Wrap(err, cnierrors.ErrInternal, fmt.Sprintf("Unable to de-register container:%s with minuteman", args.ContainerID)))
+			}
 		}
+	}
 
-		err = minuteman.CniDel(&minutemanArgs)
-		if err != nil {
-			return fmt.Errorf("Unable to register container:%s with minuteman: %s", args.ContainerID, err)
-		}
+	// When chained, the runtime invokes DEL on the other plugins in the
+	// chain itself.
+	if conf.Chained() {
+		return firstErr
 	}
 
 	// Invoke the delegate plugin.
 	delegateConf, delegatePlugin, err := conf.SetupDelegateConf()
 	if err != nil {
-		return fmt.Errorf("failed to retrieve delegate configuration: %s", err)
+		fail(cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to retrieve delegate configuration"))
+		return firstErr
+	}
+
+	err = invoke.DelegateDel(context.TODO(), delegatePlugin, delegateConf, nil)
+	if err != nil {
+		fail(cnierrors.Delegate(err, fmt.Sprintf("failed to invoke delegate plugin %s", delegatePlugin)))
+	}
+
+	return firstErr
+}
+
+// delegatePrevResult returns the `prevResult` to hand to the delegate
+// during CHECK. The runtime hands us the result of ADD, in which the
+// spartan network has been merged into the result of the delegate, and
+// the delegate would fail to find the spartan interfaces and addresses
+// among its own.
+func delegatePrevResult(args *skel.CmdArgs, conf *l4lb.NetConf) (map[string]interface{}, error) {
+	if conf.RawPrevResult == nil || !conf.Spartan.Enable {
+		return conf.RawPrevResult, nil
+	}
+
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to parse prevResult")
 	}
 
-	err = invoke.DelegateDel(delegatePlugin, delegateConf)
+	result, err := current.NewResultFromResult(conf.PrevResult)
 	if err != nil {
-		return fmt.Errorf("failed to invoke delegate plugin %s: %s", delegatePlugin, err)
+		return nil, cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to convert prevResult")
+	}
+
+	// The routes to the spartan IPs are only known once they have been
+	// discovered.
+	if err := conf.Spartan.DiscoverIPs(); err != nil {
+		return nil, err
+	}
+
+	// What `spartan.CniAdd` added to the result.
+	spartanResult := &current.Result{
+		Interfaces: []*current.Interface{
+			{Name: spartan.HostVethName(args.ContainerID, args.IfName)},
+			{Name: conf.Spartan.Interface, Sandbox: args.Netns},
+		},
+	}
+	for _, spartanIP := range conf.Spartan.Nameservers() {
+		spartanResult.Routes = append(spartanResult.Routes, &types.Route{Dst: spartanIP})
+	}
+
+	delegateResult, err := l4lb.ConvertResult(l4lb.UnmergeResult(result, spartanResult), conf.CNIVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(delegateResult)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to marshal the delegate's prevResult")
+	}
+
+	prevResult := map[string]interface{}{}
+	if err := json.Unmarshal(data, &prevResult); err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to unmarshal the delegate's prevResult")
+	}
+
+	return prevResult, nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf := l4lb.NewNetConf()
+
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load netconf")
+	}
+
+	// The delegate gets to validate its own state first, using its own
+	// part of the `prevResult` that the runtime handed to us. When
+	// chained, the runtime checks the other plugins in the chain itself.
+	if !conf.Chained() {
+		prevResult, err := delegatePrevResult(args, conf)
+		if err != nil {
+			return err
+		}
+		conf.RawPrevResult = prevResult
+
+		delegateConf, delegatePlugin, err := conf.SetupDelegateConf()
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to retrieve delegate configuration")
+		}
+
+		err = invoke.DelegateCheck(context.TODO(), delegatePlugin, delegateConf, nil)
+		if err != nil {
+			return cnierrors.Delegate(err, fmt.Sprintf("delegate plugin %s failed CHECK", delegatePlugin))
+		}
+	}
+
+	if conf.Spartan.Enable {
+		err := spartan.CniCheck(args, conf.Spartan)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInternal, fmt.Sprintf("spartan network check failed for container:%s", args.ContainerID))
+		}
+	}
+
+	if conf.Minuteman.Enable {
+		var err error
+		minutemanArgs := *args
+		minutemanArgs.StdinData, err = json.Marshal(conf.Minuteman)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshal the minuteman configuration into STDIN for the minuteman plugin")
+		}
+
+		err = minuteman.CniCheck(&minutemanArgs)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInternal, fmt.Sprintf("minuteman check failed for container:%s", args.ContainerID))
+		}
+	}
+
+	return nil
+}
+
+func cmdGC(args *skel.CmdArgs) error {
+	conf := l4lb.NewNetConf()
+
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load netconf")
+	}
+
+	// When chained, the runtime invokes GC on the other plugins in the
+	// chain itself.
+	if !conf.Chained() {
+		delegateConf, delegatePlugin, err := conf.SetupDelegateConf()
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to retrieve delegate configuration")
+		}
+
+		err = invoke.DelegateGC(context.TODO(), delegatePlugin, delegateConf, nil)
+		if err != nil {
+			return cnierrors.Delegate(err, fmt.Sprintf("delegate plugin %s failed GC", delegatePlugin))
+		}
+	}
+
+	if conf.Spartan.Enable {
+		err := spartan.CniGC(args, conf.Spartan, conf.Name, conf.ValidAttachments)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to garbage collect the spartan network")
+		}
+	}
+
+	if conf.Minuteman.Enable {
+		var err error
+		minutemanArgs := *args
+		minutemanArgs.StdinData, err = json.Marshal(conf.Minuteman)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshal the minuteman configuration into STDIN for the minuteman plugin")
+		}
+
+		err = minuteman.CniGC(&minutemanArgs, conf.Name, conf.ValidAttachments)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to garbage collect minuteman registrations")
+		}
 	}
 
 	return nil
 }
 
+// findPlugin checks that the binary of `plugin` can be found on CNI_PATH.
+func findPlugin(args *skel.CmdArgs, plugin string) error {
+	if _, err := invoke.FindInPath(plugin, filepath.SplitList(args.Path)); err != nil {
+		return cnierrors.New(cnierrors.ErrPluginNotAvailable, fmt.Sprintf("plugin %s not found in CNI_PATH %s", plugin, args.Path), err.Error())
+	}
+
+	return nil
+}
+
+// ip4ForwardPath is the sysctl that ADD sets to enable IPv4 forwarding.
+const ip4ForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// checkIP4Forward checks that IPv4 forwarding can be enabled, without
+// enabling it. ADD enables it, so that it being disabled on a fresh host
+// must not keep the runtime from sending ADDs.
+func checkIP4Forward() error {
+	if err := unix.Access(ip4ForwardPath, unix.W_OK); err != nil {
+		return cnierrors.New(cnierrors.ErrPluginNotAvailable, "unable to enable forwarding", fmt.Sprintf("%s: %s", ip4ForwardPath, err))
+	}
+
+	return nil
+}
+
+func cmdStatus(args *skel.CmdArgs) error {
+	conf := l4lb.NewNetConf()
+
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load netconf")
+	}
+
+	if err := checkIP4Forward(); err != nil {
+		return err
+	}
+
+	if !conf.Chained() {
+		_, delegatePlugin, err := conf.SetupDelegateConf()
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to retrieve delegate configuration")
+		}
+
+		if err := findPlugin(args, delegatePlugin); err != nil {
+			return err
+		}
+	}
+
+	if conf.Spartan.Enable {
+		// The built-in allocator doesn't need a plugin binary.
+		if conf.Spartan.IPAM.Type != spartan.BuiltinIPAM {
+			if err := findPlugin(args, conf.Spartan.IPAM.Type); err != nil {
+				return err
+			}
+		}
+
+		if err := spartan.CniStatus(conf.Spartan); err != nil {
+			return err
+		}
+	}
+
+	if conf.Minuteman.Enable {
+		var err error
+		minutemanArgs := *args
+		minutemanArgs.StdinData, err = json.Marshal(conf.Minuteman)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshal the minuteman configuration into STDIN for the minuteman plugin")
+		}
+
+		if err := minuteman.CniStatus(&minutemanArgs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconcileCommand is the argument that makes dcos-l4lb reconcile the VIPs
+// of running containers instead of acting as a CNI plugin.
+const reconcileCommand = "reconcile"
+
+// cmdReconcile assigns the VIPs currently configured for the network whose
+// configuration is read from `stdin` to every container running on it. It
+// is meant to be run whenever the VIPs change, such as by whatever writes
+// the `vipFile`.
+func cmdReconcile(stdin io.Reader) error {
+	data, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to read netconf")
+	}
+
+	conf := l4lb.NewNetConf()
+	if err := json.Unmarshal(data, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load netconf")
+	}
+
+	if !conf.Minuteman.Enable {
+		return nil
+	}
+
+	return minuteman.Reconcile(conf.Minuteman, conf.Name)
+}
+
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	if len(os.Args) == 2 && os.Args[1] == reconcileCommand {
+		if err := cmdReconcile(os.Stdin); err != nil {
+			log.Fatalf("failed to reconcile the VIPs: %s", err)
+		}
+		return
+	}
+
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Check:  cmdCheck,
+		Del:    cmdDel,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, "dcos-l4lb: attaches containers to the DC/OS spartan and minuteman services")
 }
@@ -1,24 +1,109 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/containernetworking/cni/pkg/ip"
-	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/testutils"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+	"github.com/dcos/dcos-cni/pkg/l4lb"
 	"github.com/dcos/dcos-cni/pkg/minuteman"
 	"github.com/dcos/dcos-cni/pkg/spartan"
 
+	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
+// l4lbConf returns the configuration of a `spartan-net` network wrapping
+// the bridge plugin. Every key of `overrides` replaces the top-level field
+// of the same name, or removes it if its value is nil.
+func l4lbConf(cniVersion string, overrides map[string]interface{}) string {
+	conf := map[string]interface{}{
+		"cniVersion": cniVersion,
+		"name":       "spartan-net",
+		"type":       "dcos-l4lb",
+		"delegate": map[string]interface{}{
+			"type":   "bridge",
+			"bridge": "mesos-cni0",
+			"ipMasq": true,
+			"mtu":    5000,
+			"ipam": map[string]interface{}{
+				"type":   "host-local",
+				"subnet": "10.1.2.0/24",
+				"routes": []interface{}{
+					map[string]interface{}{"dst": "0.0.0.0/0"},
+				},
+			},
+		},
+	}
+
+	for key, value := range overrides {
+		if value == nil {
+			delete(conf, key)
+		} else {
+			conf[key] = value
+		}
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(data)
+}
+
+// chainedConf is like `l4lbConf`, except that the network runs chained,
+// after a plugin that gave the container 10.1.2.5/24 on `eth0`.
+func chainedConf(cniVersion string, overrides map[string]interface{}) string {
+	ipc := map[string]interface{}{"address": "10.1.2.5/24", "interface": 0}
+
+	// IPs only lost their `version` with CNI spec 1.0.0.
+	if versioned, _ := version.GreaterThanOrEqualTo(cniVersion, "1.0.0"); !versioned {
+		ipc["version"] = "4"
+	}
+
+	conf := map[string]interface{}{
+		"delegate": nil,
+		"prevResult": map[string]interface{}{
+			"cniVersion": cniVersion,
+			"interfaces": []interface{}{
+				map[string]interface{}{"name": "eth0"},
+			},
+			"ips": []interface{}{ipc},
+			"dns": map[string]interface{}{
+				"nameservers": []string{"10.1.2.1"},
+			},
+		},
+	}
+
+	for key, value := range overrides {
+		conf[key] = value
+	}
+
+	return l4lbConf(cniVersion, conf)
+}
+
 var _ = Describe("L4lb", func() {
 	type L4lbCase struct {
 		Conf        string
@@ -26,6 +111,8 @@ var _ = Describe("L4lb", func() {
 		Minuteman   bool
 		ContainerID string
 		Path        string
+		Check       bool
+		Labels      map[string]string
 	}
 
 	var originalNS ns.NetNS
@@ -34,41 +121,19 @@ var _ = Describe("L4lb", func() {
 	BeforeEach(func() {
 		// Create a new NetNS so we don't modify the host
 		var err error
-		originalNS, err = ns.NewNS()
-		Expect(err).NotTo(HaveOccurred())
-
-		// Create dummy spartan interface in this namespace.
-		dummy := &netlink.Dummy{
-			LinkAttrs: netlink.LinkAttrs{
-				Name:  spartanHostIfName,
-				Flags: net.FlagUp,
-				MTU:   1500,
-			},
-		}
-
-		err = netlink.LinkAdd(dummy)
-		Expect(err).NotTo(HaveOccurred())
-
-		// Bring the interface up.
-		err = netlink.LinkSetUp(dummy)
+		originalNS, err = testutils.NewNS()
 		Expect(err).NotTo(HaveOccurred())
 
-		for _, spartanIP := range spartan.IPs {
-			// Assign a /32 sparatn IP to this interface.
-			addr := &netlink.Addr{
-				IPNet: &spartanIP,
-				Label: "",
-			}
-			err = netlink.AddrAdd(dummy, addr)
-			Expect(err).NotTo(HaveOccurred())
-		}
+		// Create dummy spartan interface in this namespace, with the
+		// spartan IPs.
+		Expect(spartan.NewNetConf().CreateHostInterface()).To(Succeed())
 	})
 
 	AfterEach(func() {
 		// Remove the spartan dummy interface.
 		Expect(originalNS.Close()).To(Succeed())
 
-		_, err := ip.DelLinkByNameAddr(spartanHostIfName, netlink.FAMILY_V4)
+		_, err := ip.DelLinkByNameAddr(spartanHostIfName)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
@@ -79,7 +144,7 @@ var _ = Describe("L4lb", func() {
 
 			By("Adding a CNI configuration enabling spartan network")
 
-			targetNS, err := ns.NewNS()
+			targetNS, err := testutils.NewNS()
 			Expect(err).NotTo(HaveOccurred())
 			defer targetNS.Close()
 
@@ -93,10 +158,13 @@ var _ = Describe("L4lb", func() {
 			// Execute the plugin with the ADD command, creating the veth
 			// endpoints.
 			By("Invoking ADD to attach container to spartan network")
+			var addResult types.Result
+			var prevResult []byte
 			err = originalNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
 
-				_, _, err := testutils.CmdAddWithResult(targetNS.Path(), IFNAME, []byte(conf), func() error {
+				var err error
+				addResult, prevResult, err = testutils.CmdAddWithArgs(args, func() error {
 					return cmdAdd(args)
 				})
 				Expect(err).NotTo(HaveOccurred(), "Couldn't invoke CNI ADD on the plugin")
@@ -104,6 +172,57 @@ var _ = Describe("L4lb", func() {
 			})
 			Expect(err).NotTo(HaveOccurred())
 
+			// Interfaces are only part of results from CNI spec 0.3.0 onwards.
+			hasInterfaces, err := version.GreaterThanOrEqualTo(addResult.Version(), "0.3.0")
+			Expect(err).NotTo(HaveOccurred())
+			if hasInterfaces {
+				By("Checking if the result describes the spartan network")
+				result, err := current.GetResult(addResult)
+				Expect(err).NotTo(HaveOccurred())
+
+				var spartanIface *current.Interface
+				spartanIndex := -1
+				for i, iface := range result.Interfaces {
+					if iface.Name == spartan.IfName && iface.Sandbox == targetNS.Path() {
+						spartanIface, spartanIndex = iface, i
+					}
+				}
+
+				if input.Spartan {
+					Expect(spartanIface).NotTo(BeNil(), "spartan interface missing from the result")
+
+					var spartanIP *current.IPConfig
+					for _, ipc := range result.IPs {
+						if ipc.Interface != nil && *ipc.Interface == spartanIndex {
+							spartanIP = ipc
+						}
+					}
+					Expect(spartanIP).NotTo(BeNil(), "spartan IP missing from the result")
+					Expect(spartanIP.Address.Mask).To(Equal(net.CIDRMask(32, 32)))
+
+					var routes []string
+					for _, route := range result.Routes {
+						routes = append(routes, route.Dst.String())
+					}
+					for _, spartanIP := range spartan.IPs {
+						Expect(routes).To(ContainElement(spartanIP.String()))
+					}
+				} else {
+					Expect(spartanIface).To(BeNil(), "spartan interface should not be in the result")
+				}
+			}
+
+			By("Checking if the result points DNS resolution at spartan")
+			result, err := current.GetResult(addResult)
+			Expect(err).NotTo(HaveOccurred())
+			for _, spartanIP := range spartan.IPs {
+				if input.Spartan {
+					Expect(result.DNS.Nameservers).To(ContainElement(spartanIP.IP.String()))
+				} else {
+					Expect(result.DNS.Nameservers).NotTo(ContainElement(spartanIP.IP.String()))
+				}
+			}
+
 			By("Checking if container has the spartan and minuteman interfaces configured")
 			err = targetNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
@@ -126,26 +245,61 @@ var _ = Describe("L4lb", func() {
 					Expect(err).To(HaveOccurred())
 				}
 
-				// TODO(asridharan): Run the ping command for each of the spartan IP.
+				// Reaching the spartan IPs is covered by the probe tests.
 				return nil
 			})
 
 			By("Checking if plugin has registered network namespace with minuteman")
-			netns, err := ioutil.ReadFile(input.Path + "/" + input.ContainerID)
+			registration, err := minuteman.ReadRegistration(input.Path, input.ContainerID)
 			if input.Minuteman {
 				Expect(err).NotTo(HaveOccurred())
-				Ω(string(netns)).Should(Equal(targetNS.Path()))
+				Ω(registration.Version).Should(Equal(minuteman.RegistrationVersion))
+				Ω(registration.Netns).Should(Equal(targetNS.Path()))
+				Ω(registration.IfName).Should(Equal(IFNAME))
+				Ω(registration.Network).Should(Equal("spartan-net"))
+				Ω(registration.ContainerIPs).Should(HaveLen(1))
+				Ω(registration.Labels).Should(Equal(input.Labels))
+				if input.Spartan {
+					Ω(registration.SpartanIPs).Should(HaveLen(1))
+				} else {
+					Ω(registration.SpartanIPs).Should(BeEmpty())
+				}
 			} else {
 				Expect(err).To(HaveOccurred())
 			}
 
+			if input.Check {
+				By("Invoking CHECK to verify the container is still attached")
+				checkConf := make(map[string]interface{})
+				Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+
+				rawPrevResult := make(map[string]interface{})
+				Expect(json.Unmarshal(prevResult, &rawPrevResult)).To(Succeed())
+				checkConf["prevResult"] = rawPrevResult
+
+				checkArgs := *args
+				checkArgs.StdinData, err = json.Marshal(checkConf)
+				Expect(err).NotTo(HaveOccurred())
+
+				err = originalNS.Do(func(ns.NetNS) error {
+					defer GinkgoRecover()
+
+					err := testutils.CmdCheckWithArgs(&checkArgs, func() error {
+						return cmdCheck(&checkArgs)
+					})
+					Expect(err).NotTo(HaveOccurred(), "CNI CHECK failed on an attached container")
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
 			// Call the plugins with the DEL command, deleting the veth
 			// endpoints.
 			By("Invoking DEL to detach container from the spartan network")
 			err = originalNS.Do(func(ns.NetNS) error {
 				defer GinkgoRecover()
 
-				err := testutils.CmdDelWithResult(targetNS.Path(), IFNAME, func() error {
+				err := testutils.CmdDelWithArgs(args, func() error {
 					return cmdDel(args)
 				})
 				Expect(err).NotTo(HaveOccurred())
@@ -209,6 +363,14 @@ var _ = Describe("L4lb", func() {
 					"minuteman": {
 						"path": "/tmp/minuteman_cni_test"
 					},
+					"args": {
+						"org.apache.mesos": {
+							"network_info": {
+								"name": "dcos",
+								"labels": { "labels": [ { "key": "app", "value": "web" } ] }
+							}
+						}
+					},
 					"delegate" : {
 						"type" : "bridge",
 						"bridge": "mesos-cni0",
@@ -226,6 +388,7 @@ var _ = Describe("L4lb", func() {
 				Spartan:     true,
 				Minuteman:   true,
 				Path:        "/tmp/minuteman_cni_test",
+				Labels:      map[string]string{"app": "web"},
 				ContainerID: "dummy"}),
 		Entry("Spartan Disabled",
 			L4lbCase{
@@ -257,5 +420,1690 @@ var _ = Describe("L4lb", func() {
 				Minuteman:   true,
 				Path:        minuteman.DefaultPath,
 				ContainerID: "dummy"}),
+		Entry("CHECK",
+			L4lbCase{
+				Conf:        l4lbConf("0.4.0", nil),
+				Spartan:     true,
+				Minuteman:   true,
+				Path:        minuteman.DefaultPath,
+				ContainerID: "dummy",
+				Check:       true}),
+		Entry("CNI 1.0.0",
+			L4lbCase{
+				Conf:        l4lbConf("1.0.0", nil),
+				Spartan:     true,
+				Minuteman:   true,
+				Path:        minuteman.DefaultPath,
+				ContainerID: "dummy",
+				Check:       true}),
+		Entry("Chained",
+			L4lbCase{
+				Conf:        chainedConf("0.4.0", nil),
+				Spartan:     true,
+				Minuteman:   true,
+				Path:        minuteman.DefaultPath,
+				ContainerID: "dummy",
+				Check:       true}),
 	)
+
+	It("Rolls back the delegate and spartan network when a later step fails", func() {
+		const IFNAME = "eth0"
+
+		dataDir, err := ioutil.TempDir("", "spartan")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		// Minuteman can't create its registration directory under a
+		// regular file, so ADD fails after the delegate and spartan
+		// steps have succeeded.
+		conf := l4lbConf("0.2.0", map[string]interface{}{
+			"spartan": map[string]interface{}{
+				"ipam": map[string]interface{}{"dataDir": dataDir},
+			},
+			"minuteman": json.RawMessage(`{ "path": "/dev/null/minuteman" }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "rollback",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		By("Invoking ADD with a minuteman configuration that fails")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue(), "ADD should fail with a CNI error")
+			Expect(cniErr.Code).To(Equal(cnierrors.ErrIOFailure))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking that the container has no interfaces left behind")
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for _, ifName := range []string{IFNAME, spartan.IfName, minuteman.IfName} {
+				_, err := netlink.LinkByName(ifName)
+				Expect(err).To(HaveOccurred(), "interface `%s` still present after a failed ADD", ifName)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking that the spartan lease has been released")
+		entries, err := ioutil.ReadDir(filepath.Join(dataDir, spartan.NetworkName))
+		Expect(err).NotTo(HaveOccurred())
+
+		// The host-local IPAM plugin keeps a lease file named after each
+		// leased address.
+		var leases []string
+		for _, entry := range entries {
+			if net.ParseIP(entry.Name()) != nil {
+				leases = append(leases, entry.Name())
+			}
+		}
+		Expect(leases).To(BeEmpty(), "spartan lease left behind by a failed ADD")
+	})
+
+	It("Tolerates ADD and DEL being retried", func() {
+		const IFNAME = "eth0"
+		// Run chained, so that retrying ADD only exercises the spartan
+		// and minuteman state owned by this plugin.
+		conf := chainedConf("0.4.0", nil)
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+
+		args := &skel.CmdArgs{
+			ContainerID: "retry",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		for i := 0; i < 2; i++ {
+			By("Invoking ADD")
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred(), "ADD failed on attempt %d", i+1)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		By("Checking that the container has a single spartan address")
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(spartan.IfName)
+			Expect(err).NotTo(HaveOccurred())
+
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+
+			_, err = netlink.LinkByName(minuteman.IfName)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 2; i++ {
+			By("Invoking DEL")
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				err := testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred(), "DEL failed on attempt %d", i+1)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		By("Invoking DEL after the network namespace is gone")
+		Expect(targetNS.Close()).To(Succeed())
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Carries on with DEL when detaching from the spartan network fails", func() {
+		const IFNAME = "eth0"
+
+		path, err := ioutil.TempDir("", "minuteman")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(path)
+		defer os.RemoveAll(path + ".state")
+
+		minutemanConf := json.RawMessage(fmt.Sprintf(`{ "enable": true, "path": %q }`, path))
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"minuteman": minutemanConf,
+		})
+		// The spartan IPAM plugin can't be found during DEL.
+		brokenConf := chainedConf("0.4.0", map[string]interface{}{
+			"spartan":   json.RawMessage(`{ "enable": true, "ipam": { "type": "missing-ipam" } }`),
+			"minuteman": minutemanConf,
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "del-best-effort",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Join(path, args.ContainerID)).To(BeAnExistingFile())
+
+		By("Invoking DEL with a spartan configuration that fails")
+		brokenArgs := *args
+		brokenArgs.StdinData = []byte(brokenConf)
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(&brokenArgs, func() error {
+				return cmdDel(&brokenArgs)
+			})
+		})
+		Expect(err).To(HaveOccurred())
+
+		By("Checking that the container was de-registered from minuteman nonetheless")
+		Expect(filepath.Join(path, args.ContainerID)).NotTo(BeAnExistingFile())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			_, err := netlink.LinkByName(minuteman.IfName)
+			if err == nil {
+				return fmt.Errorf("interface `%s` still present after DEL", minuteman.IfName)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Invoking DEL again")
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Names the host veth after the container and removes it once the netns is gone", func() {
+		const IFNAME = "eth0"
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "veth-name",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		hostVethName := spartan.HostVethName(args.ContainerID, IFNAME)
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			addResult, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(addResult)
+			Expect(err).NotTo(HaveOccurred())
+			// The spartan veth follows the interface of the previous
+			// plugin in the chain.
+			Expect(result.Interfaces[1].Name).To(Equal(hostVethName))
+
+			link, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Alias).To(Equal("spartan-net/" + args.ContainerID))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Invoking DEL after the netns path is gone, while the netns itself lives on")
+		Expect(testutils.UnmountNS(targetNS)).To(Succeed())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = netlink.LinkByName(hostVethName)
+			Expect(err).To(HaveOccurred(), "host veth %s still present after DEL", hostVethName)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Leaves a host veth of another container with a colliding name alone", func() {
+		const IFNAME = "eth0"
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		args := &skel.CmdArgs{
+			ContainerID: "veth-collision",
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		hostVethName := spartan.HostVethName(args.ContainerID, IFNAME)
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			By("Setting up a veth of another container under the same name")
+			veth := &netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: hostVethName},
+				PeerName:  "collision-peer",
+			}
+			Expect(netlink.LinkAdd(veth)).To(Succeed())
+			defer netlink.LinkDel(veth)
+
+			link, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetAlias(link, "spartan-net/another-container")).To(Succeed())
+
+			By("Invoking DEL")
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred(), "host veth %s of another container removed by DEL", hostVethName)
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Allocates spartan IPs with the built-in allocator", func() {
+		const IFNAME = "eth0"
+
+		dataDir, err := ioutil.TempDir("", "spartan")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"spartan": map[string]interface{}{
+				"ipam": map[string]interface{}{"type": "builtin", "dataDir": dataDir},
+			},
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		// No IPAM plugin can be found on this path.
+		args := &skel.CmdArgs{
+			ContainerID: "builtin-ipam",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			Path:        "/nonexistent",
+			StdinData:   []byte(conf),
+		}
+		lease := filepath.Join(dataDir, spartan.NetworkName, "198.51.100.10")
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			addResult, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := current.GetResult(addResult)
+			Expect(err).NotTo(HaveOccurred())
+
+			var addrs []string
+			for _, ipc := range result.IPs {
+				addrs = append(addrs, ipc.Address.IP.String())
+			}
+			Expect(addrs).To(ContainElement("198.51.100.10"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := ioutil.ReadFile(lease)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(args.ContainerID + "\r\n" + IFNAME))
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lease).NotTo(BeAnExistingFile())
+	})
+
+	It("Writes a resolv.conf for the container and removes it on DEL", func() {
+		const IFNAME = "eth0"
+
+		dir, err := ioutil.TempDir("", "resolv")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"spartan": map[string]interface{}{
+				"dns": map[string]interface{}{
+					"resolvConfDir": dir,
+					"search":        []string{"marathon.l4lb.thisdcos.directory"},
+				},
+			},
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "resolv-conf",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		resolvConf := filepath.Join(dir, args.ContainerID, "resolv.conf")
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, out, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			printed := map[string]interface{}{}
+			Expect(json.Unmarshal(out, &printed)).To(Succeed())
+			Expect(printed).To(HaveKeyWithValue(l4lb.ResolvConfKey, resolvConf))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := ioutil.ReadFile(resolvConf)
+		Expect(err).NotTo(HaveOccurred())
+		for _, spartanIP := range spartan.IPs {
+			Expect(string(data)).To(ContainSubstring("nameserver " + spartanIP.IP.String() + "\n"))
+		}
+		Expect(string(data)).To(ContainSubstring("search marathon.l4lb.thisdcos.directory\n"))
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resolvConf).NotTo(BeAnExistingFile())
+	})
+
+	It("Redirects the container's DNS queries to spartan", func() {
+		const IFNAME = "eth0"
+
+		overrides := map[string]interface{}{
+			"spartan":   json.RawMessage(`{ "dnat": { "enable": true, "exempt": ["10.0.0.0/8"] } }`),
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		}
+		conf := chainedConf("0.4.0", overrides)
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dnat",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		By("Invoking ADD")
+		var result *current.Result
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err = current.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		dnsRules := func() []string {
+			var rules []string
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				ipt, err := iptables.New()
+				Expect(err).NotTo(HaveOccurred())
+
+				exists, err := ipt.ChainExists("nat", "SPARTAN-DNS")
+				Expect(err).NotTo(HaveOccurred())
+				if !exists {
+					return nil
+				}
+
+				rules, err = ipt.List("nat", "SPARTAN-DNS")
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return rules
+		}
+
+		rules := strings.Join(dnsRules(), "\n")
+		Expect(rules).To(ContainSubstring("-d 10.0.0.0/8 -j RETURN"))
+		for _, spartanIP := range spartan.IPs {
+			Expect(rules).To(ContainSubstring("-d " + spartanIP.String() + " -j RETURN"))
+		}
+		Expect(rules).To(ContainSubstring("-p udp -j DNAT --to-destination " + spartan.IPs[0].IP.String()))
+		Expect(rules).To(ContainSubstring("-p tcp -j DNAT --to-destination " + spartan.IPs[0].IP.String()))
+
+		check := func() error {
+			overrides["prevResult"] = result
+
+			checkArgs := *args
+			checkArgs.StdinData = []byte(chainedConf("0.4.0", overrides))
+			return originalNS.Do(func(ns.NetNS) error {
+				return testutils.CmdCheckWithArgs(&checkArgs, func() error {
+					return cmdCheck(&checkArgs)
+				})
+			})
+		}
+
+		By("Invoking CHECK")
+		Expect(check()).To(Succeed())
+
+		By("Invoking CHECK once the redirection is gone")
+		err = targetNS.Do(func(ns.NetNS) error {
+			ipt, err := iptables.New()
+			if err != nil {
+				return err
+			}
+
+			return ipt.Delete("nat", "OUTPUT", "-p", "udp", "--dport", "53", "-j", "SPARTAN-DNS")
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = check()
+		Expect(err).To(HaveOccurred())
+
+		cniErr, ok := err.(*types.Error)
+		Expect(ok).To(BeTrue())
+		Expect(cniErr.Code).To(Equal(cnierrors.ErrFirewallFailure))
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dnsRules()).To(BeEmpty())
+	})
+
+	It("Verifies or creates the host spartan interface", func() {
+		const IFNAME = "eth0"
+
+		add := func(mode, containerID string) error {
+			conf := chainedConf("0.4.0", map[string]interface{}{
+				"spartan":   map[string]interface{}{"hostInterface": mode},
+				"minuteman": json.RawMessage(`{ "enable": false }`),
+			})
+
+			targetNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNS.Close()
+
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			// The spartan interface of `BeforeEach` lives outside of
+			// `originalNS`.
+			return originalNS.Do(func(ns.NetNS) error {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				if err != nil {
+					return err
+				}
+
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+		}
+
+		By("Failing ADD while the host interface is missing")
+		err := add(spartan.HostInterfaceVerify, "verify")
+		Expect(err).To(HaveOccurred())
+
+		cniErr, ok := err.(*types.Error)
+		Expect(ok).To(BeTrue())
+		Expect(cniErr.Code).To(Equal(cnierrors.ErrInterfaceFailure))
+
+		By("Creating the host interface")
+		Expect(add(spartan.HostInterfaceCreate, "create")).To(Succeed())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(spartanHostIfName)
+			Expect(err).NotTo(HaveOccurred())
+
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+
+			var ips []string
+			for _, addr := range addrs {
+				ips = append(ips, addr.IPNet.String())
+			}
+
+			for _, spartanIP := range spartan.IPs {
+				Expect(ips).To(ContainElement(spartanIP.String()))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Reusing the host interface")
+		Expect(add(spartan.HostInterfaceCreate, "create-again")).To(Succeed())
+		Expect(add(spartan.HostInterfaceVerify, "verify-again")).To(Succeed())
+	})
+
+	It("Assigns the VIPs to the minuteman interface and follows changes to them", func() {
+		const IFNAME = "eth0"
+
+		path, err := ioutil.TempDir("", "minuteman")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(path)
+		defer os.RemoveAll(path + ".state")
+
+		vipFile := filepath.Join(path, "vips")
+		Expect(ioutil.WriteFile(vipFile, []byte("11.1.0.0/24\n"), 0644)).To(Succeed())
+
+		minutemanConf := &minuteman.NetConf{
+			Enable:  true,
+			Path:    filepath.Join(path, "l4lb"),
+			VIPs:    []types.IPNet{{IP: net.IPv4(11, 0, 0, 1), Mask: net.CIDRMask(32, 32)}},
+			VIPFile: vipFile,
+		}
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"spartan":   json.RawMessage(`{ "enable": false }`),
+			"minuteman": minutemanConf,
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "vips",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		vips := func() []string {
+			var cidrs []string
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(minuteman.IfName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, addr := range addrs {
+					cidrs = append(cidrs, addr.IPNet.String())
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return cidrs
+		}
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vips()).To(ConsistOf("11.0.0.1/32", "11.1.0.0/24"))
+
+		By("Checking that the container accepts traffic to the whole VIP range")
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			routes, err := netlink.RouteGet(net.ParseIP("11.1.0.42"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).NotTo(BeEmpty())
+			Expect(routes[0].Type).To(Equal(unix.RTN_LOCAL))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Assigning a VIP from outside of the plugin")
+		err = targetNS.Do(func(ns.NetNS) error {
+			link, err := netlink.LinkByName(minuteman.IfName)
+			if err != nil {
+				return err
+			}
+
+			addr, err := netlink.ParseAddr("12.0.0.1/32")
+			if err != nil {
+				return err
+			}
+
+			return netlink.AddrAdd(link, addr)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Invoking ADD again")
+		err = originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vips()).To(ConsistOf("11.0.0.1/32", "11.1.0.0/24", "12.0.0.1/32"))
+
+		By("Reconciling the VIPs once the VIP file changes")
+		Expect(ioutil.WriteFile(vipFile, []byte("11.2.0.1\n"), 0644)).To(Succeed())
+
+		Expect(cmdReconcile(strings.NewReader(conf))).To(Succeed())
+		Expect(vips()).To(ConsistOf("11.0.0.1/32", "11.2.0.1/32", "12.0.0.1/32"))
+
+		By("Reconciling without VIPs configured")
+		Expect(minuteman.Reconcile(&minuteman.NetConf{Enable: true, Path: minutemanConf.Path}, "spartan-net")).To(Succeed())
+		Expect(vips()).To(ConsistOf("12.0.0.1/32"))
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Only reconciles the VIPs of the network being reconciled", func() {
+		const IFNAME = "eth0"
+
+		path, err := ioutil.TempDir("", "minuteman")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(path)
+		defer os.RemoveAll(path + ".state")
+
+		// Both networks share the registration directory.
+		confs := map[string]*minuteman.NetConf{
+			"spartan-net": {
+				Enable: true,
+				Path:   path,
+				VIPs:   []types.IPNet{{IP: net.IPv4(11, 0, 0, 1), Mask: net.CIDRMask(32, 32)}},
+			},
+			"other-net": {
+				Enable: true,
+				Path:   path,
+				VIPs:   []types.IPNet{{IP: net.IPv4(11, 0, 0, 2), Mask: net.CIDRMask(32, 32)}},
+			},
+		}
+
+		namespaces := map[string]ns.NetNS{}
+		for network, minutemanConf := range confs {
+			targetNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNS.Close()
+			namespaces[network] = targetNS
+
+			args := &skel.CmdArgs{
+				ContainerID: network,
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData: []byte(chainedConf("0.4.0", map[string]interface{}{
+					"name":      network,
+					"spartan":   json.RawMessage(`{ "enable": false }`),
+					"minuteman": minutemanConf,
+				})),
+			}
+
+			By(fmt.Sprintf("Invoking ADD on %s", network))
+			err = originalNS.Do(func(ns.NetNS) error {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			defer originalNS.Do(func(ns.NetNS) error {
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+		}
+
+		vips := func(network string) []string {
+			var cidrs []string
+			err := namespaces[network].Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(minuteman.IfName)
+				Expect(err).NotTo(HaveOccurred())
+
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+
+				for _, addr := range addrs {
+					cidrs = append(cidrs, addr.IPNet.String())
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return cidrs
+		}
+
+		recorded := func(network string) []string {
+			registration, err := minuteman.ReadRegistration(path, network)
+			Expect(err).NotTo(HaveOccurred())
+
+			var cidrs []string
+			for _, vip := range registration.VIPs {
+				ipNet := net.IPNet(vip)
+				cidrs = append(cidrs, ipNet.String())
+			}
+			return cidrs
+		}
+
+		Expect(vips("spartan-net")).To(ConsistOf("11.0.0.1/32"))
+		Expect(vips("other-net")).To(ConsistOf("11.0.0.2/32"))
+
+		By("Reconciling each network in turn")
+		for i := 0; i < 2; i++ {
+			Expect(minuteman.Reconcile(confs["spartan-net"], "spartan-net")).To(Succeed())
+			Expect(minuteman.Reconcile(confs["other-net"], "other-net")).To(Succeed())
+		}
+
+		Expect(vips("spartan-net")).To(ConsistOf("11.0.0.1/32"))
+		Expect(vips("other-net")).To(ConsistOf("11.0.0.2/32"))
+		Expect(recorded("spartan-net")).To(ConsistOf("11.0.0.1/32"))
+		Expect(recorded("other-net")).To(ConsistOf("11.0.0.2/32"))
+
+		By("Reconciling one network without VIPs configured")
+		Expect(minuteman.Reconcile(&minuteman.NetConf{Enable: true, Path: path}, "spartan-net")).To(Succeed())
+
+		Expect(vips("spartan-net")).To(BeEmpty())
+		Expect(vips("other-net")).To(ConsistOf("11.0.0.2/32"))
+		Expect(recorded("spartan-net")).To(BeEmpty())
+		Expect(recorded("other-net")).To(ConsistOf("11.0.0.2/32"))
+	})
+
+	It("Doesn't hold up ADD for longer than the deadline when minuteman hangs", func() {
+		const IFNAME = "eth0"
+
+		path, err := ioutil.TempDir("", "minuteman")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(path)
+		defer os.RemoveAll(path + ".state")
+
+		hang := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			<-hang
+		}))
+		defer server.Close()
+		defer close(hang)
+
+		minutemanConf := &minuteman.NetConf{
+			Enable: true,
+			Path:   path,
+			Notify: minuteman.NotifyConf{URL: server.URL, Retries: 100, Deadline: 500},
+		}
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"spartan":   json.RawMessage(`{ "enable": false }`),
+			"minuteman": minutemanConf,
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "notify-hang",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			start := time.Now()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// The registration record is written regardless.
+		Expect(filepath.Join(path, args.ContainerID)).To(BeAnExistingFile())
+	})
+
+	It("Garbage collects containers that went away without DEL", func() {
+		const IFNAME = "eth0"
+
+		path, err := ioutil.TempDir("", "minuteman")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(path)
+		defer os.RemoveAll(path + ".state")
+
+		// gc-other is on another network, which shares the spartan
+		// network and the minuteman registration directory.
+		minutemanConf := map[string]interface{}{"enable": true, "path": path}
+		networks := map[string]string{
+			"gc-live":  "spartan-net",
+			"gc-stale": "spartan-net",
+			"gc-other": "other-net",
+		}
+
+		netns := map[string]ns.NetNS{}
+		for containerID, network := range networks {
+			targetNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNS.Close()
+			netns[containerID] = targetNS
+
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData: []byte(chainedConf("1.1.0", map[string]interface{}{
+					"name":      network,
+					"minuteman": minutemanConf,
+				})),
+			}
+
+			By("Invoking ADD for " + containerID)
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			defer func() {
+				originalNS.Do(func(ns.NetNS) error {
+					return cmdDel(args)
+				})
+			}()
+		}
+
+		By("Invoking GC with only gc-live as a valid attachment")
+		gcArgs := &skel.CmdArgs{
+			StdinData: []byte(l4lbConf("1.1.0", map[string]interface{}{
+				"delegate":                  nil,
+				"minuteman":                 minutemanConf,
+				"cni.dev/valid-attachments": []types.GCAttachment{{ContainerID: "gc-live", IfName: IFNAME}},
+			})),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			return cmdGC(gcArgs)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking that gc-stale is no longer registered with minuteman")
+		Expect(path + "/gc-live").To(BeAnExistingFile())
+		Expect(path + "/gc-stale").NotTo(BeAnExistingFile())
+		Expect(path + "/gc-other").To(BeAnExistingFile())
+
+		By("Checking that gc-stale is no longer attached to the spartan network")
+		for containerID, attached := range map[string]bool{"gc-live": true, "gc-stale": false, "gc-other": true} {
+			err = netns[containerID].Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(spartan.IfName)
+				return err
+			})
+
+			if attached {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+			}
+		}
+	})
+
+	It("Keeps live spartan veths during GC with another IPAM plugin", func() {
+		const IFNAME = "eth0"
+
+		dataDir, err := ioutil.TempDir("", "spartan")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "gc-ipam",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData: []byte(chainedConf("1.1.0", map[string]interface{}{
+				"spartan": map[string]interface{}{
+					"ipam": map[string]interface{}{"type": "builtin", "dataDir": dataDir},
+				},
+				"minuteman": json.RawMessage(`{ "enable": false }`),
+			})),
+		}
+		hostVethName := spartan.HostVethName(args.ContainerID, IFNAME)
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			originalNS.Do(func(ns.NetNS) error {
+				return cmdDel(args)
+			})
+		}()
+
+		By("Invoking GC with an IPAM plugin that keeps its leases elsewhere")
+		gcArgs := &skel.CmdArgs{
+			StdinData: []byte(l4lbConf("1.1.0", map[string]interface{}{
+				"delegate": nil,
+				"spartan": map[string]interface{}{
+					"ipam": map[string]interface{}{"type": "dhcp"},
+				},
+				"minuteman":                 json.RawMessage(`{ "enable": false }`),
+				"cni.dev/valid-attachments": []types.GCAttachment{{ContainerID: args.ContainerID, IfName: IFNAME}},
+			})),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			Expect(cmdGC(gcArgs)).To(Succeed())
+
+			_, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Discovers the spartan IPs from a host interface", func() {
+		const IFNAME = "eth0"
+		discovered := []string{"192.0.2.1", "192.0.2.2"}
+
+		// The plugin runs in `originalNS`, so that is where the host
+		// interface has to be.
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dns0"}}
+			Expect(netlink.LinkAdd(dummy)).To(Succeed())
+
+			// The network has no IPv6 range set, so that the /128 can't
+			// be reached from containers.
+			for _, addr := range append(discovered, "192.0.2.100/24", "fd00:7::1/128") {
+				if !strings.Contains(addr, "/") {
+					addr += "/32"
+				}
+
+				nlAddr, err := netlink.ParseAddr(addr)
+				Expect(err).NotTo(HaveOccurred())
+				if nlAddr.IP.To4() == nil {
+					nlAddr.Flags = unix.IFA_F_NODAD
+				}
+				Expect(netlink.AddrAdd(dummy, nlAddr)).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := chainedConf("0.4.0", map[string]interface{}{
+			"spartan":   json.RawMessage(`{ "discover": "dns0" }`),
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "discover",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		By("Invoking ADD")
+		var addResult types.Result
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			addResult, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking that the result points DNS at the discovered IPs only")
+		result, err := current.GetResult(addResult)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.DNS.Nameservers).To(Equal(discovered))
+
+		By("Checking that the container routes to the discovered IPs")
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(spartan.IfName)
+			Expect(err).NotTo(HaveOccurred())
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+
+			var dsts []string
+			for _, route := range routes {
+				if route.Dst != nil {
+					dsts = append(dsts, route.Dst.IP.String())
+				}
+			}
+			Expect(dsts).To(ConsistOf(discovered))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Removes the DNS redirection of every discovered address family on DEL", func() {
+		const IFNAME = "eth0"
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dns0"}}
+			Expect(netlink.LinkAdd(dummy)).To(Succeed())
+
+			for _, addr := range []string{"192.0.2.1/32", "fd00:6::1/128"} {
+				nlAddr, err := netlink.ParseAddr(addr)
+				Expect(err).NotTo(HaveOccurred())
+				if nlAddr.IP.To4() == nil {
+					nlAddr.Flags = unix.IFA_F_NODAD
+				}
+				Expect(netlink.AddrAdd(dummy, nlAddr)).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := chainedConf("1.0.0", map[string]interface{}{
+			"spartan": json.RawMessage(`{
+				"discover": "dns0",
+				"dnat": { "enable": true },
+				"ipam": {
+					"ranges": [[{ "subnet": "fd00:6::/64", "rangeStart": "fd00:6::10" }]]
+				}
+			}`),
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "discover-dnat",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		ip6Chain := func() bool {
+			var exists bool
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+				Expect(err).NotTo(HaveOccurred())
+
+				exists, err = ipt.ChainExists("nat", "SPARTAN-DNS")
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return exists
+		}
+
+		By("Invoking ADD")
+		err = originalNS.Do(func(ns.NetNS) error {
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip6Chain()).To(BeTrue())
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip6Chain()).To(BeFalse())
+
+		By("Invoking DEL again once the host interface is gone")
+		err = originalNS.Do(func(ns.NetNS) error {
+			if err := ip.DelLinkByName("dns0"); err != nil {
+				return err
+			}
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Attaches the container to a dual-stack spartan network", func() {
+		const IFNAME = "eth0"
+
+		conf := chainedConf("1.0.0", map[string]interface{}{
+			"spartan": json.RawMessage(`{
+				"ips": ["198.51.100.1", "fd00:5::1"],
+				"ipam": {
+					"ranges": [[{ "subnet": "fd00:5::/64", "rangeStart": "fd00:5::10" }]]
+				}
+			}`),
+			"minuteman": json.RawMessage(`{ "enable": false }`),
+		})
+
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer targetNS.Close()
+
+		args := &skel.CmdArgs{
+			ContainerID: "dual-stack",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		By("Invoking ADD")
+		var addResult types.Result
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			var err error
+			addResult, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Checking that the result carries a /32 and a /128 for the spartan interface")
+		result, err := current.GetResult(addResult)
+		Expect(err).NotTo(HaveOccurred())
+
+		var spartanAddrs []string
+		for _, ipc := range result.IPs {
+			if ipc.Interface != nil && result.Interfaces[*ipc.Interface].Name == spartan.IfName {
+				ones, _ := ipc.Address.Mask.Size()
+				spartanAddrs = append(spartanAddrs, fmt.Sprintf("%d", ones))
+			}
+		}
+		Expect(spartanAddrs).To(ConsistOf("32", "128"))
+		Expect(result.DNS.Nameservers).To(Equal([]string{"198.51.100.1", "fd00:5::1"}))
+
+		By("Checking that the container can reach the IPv6 nameserver right away")
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(spartan.IfName)
+			Expect(err).NotTo(HaveOccurred())
+
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+
+			var global []netlink.Addr
+			for _, addr := range addrs {
+				if addr.IP.IsGlobalUnicast() {
+					global = append(global, addr)
+				}
+			}
+			Expect(global).To(HaveLen(1))
+			Expect(global[0].Flags & unix.IFA_F_TENTATIVE).To(BeZero())
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+
+			var dsts []string
+			for _, route := range routes {
+				if route.Dst != nil {
+					dsts = append(dsts, route.Dst.String())
+				}
+			}
+			Expect(dsts).To(ContainElement("fd00:5::1/128"))
+
+			neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+
+			var neighIPs []string
+			for _, neigh := range neighs {
+				neighIPs = append(neighIPs, neigh.IP.String())
+			}
+			Expect(neighIPs).To(ContainElement("fd00:5::1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Invoking DEL")
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	DescribeTable("Sets the MTU of the spartan veth",
+		func(mtu, containerMTU, expectedMTU int) {
+			const IFNAME = "eth0"
+
+			// An MTU of 0 leaves it unset.
+			conf := chainedConf("0.4.0", map[string]interface{}{
+				"mtu":       mtu,
+				"minuteman": json.RawMessage(`{ "enable": false }`),
+			})
+
+			targetNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNS.Close()
+
+			// Stand in for the interface set up by the previous plugin in
+			// the chain.
+			err = targetNS.Do(func(ns.NetNS) error {
+				dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IFNAME, MTU: containerMTU}}
+				return netlink.LinkAdd(dummy)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			args := &skel.CmdArgs{
+				ContainerID: "mtu",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			By("Invoking ADD")
+			var hostVethName string
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				addResult, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := current.GetResult(addResult)
+				Expect(err).NotTo(HaveOccurred())
+				for _, iface := range result.Interfaces {
+					if iface.Sandbox == "" {
+						hostVethName = iface.Name
+					}
+				}
+
+				link, err := netlink.LinkByName(hostVethName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MTU).To(Equal(expectedMTU))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Checking the MTU of the container end")
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				link, err := netlink.LinkByName(spartan.IfName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().MTU).To(Equal(expectedMTU))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Invoking DEL")
+			err = originalNS.Do(func(ns.NetNS) error {
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("Configured", 1400, 1500, 1400),
+		Entry("Copied from the container's interface", 0, 1420, 1420),
+	)
+
+	DescribeTable("Probes the spartan nameservers",
+		func(policy string, answer, succeed bool) {
+			const IFNAME = "eth0"
+
+			// The plugin runs in `originalNS`, so that is where the
+			// spartan IPs have to be for the container to reach them.
+			var servers []net.PacketConn
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dns0", Flags: net.FlagUp}}
+				Expect(netlink.LinkAdd(dummy)).To(Succeed())
+				Expect(netlink.LinkSetUp(dummy)).To(Succeed())
+
+				for _, spartanIP := range spartan.IPs {
+					Expect(netlink.AddrAdd(dummy, &netlink.Addr{IPNet: &spartanIP})).To(Succeed())
+				}
+
+				if !answer {
+					return nil
+				}
+
+				// Like spartan, listen on each spartan IP, so that the
+				// answers come from the address the query was sent to.
+				for _, spartanIP := range spartan.IPs {
+					server, err := net.ListenPacket("udp4", net.JoinHostPort(spartanIP.IP.String(), "53"))
+					Expect(err).NotTo(HaveOccurred())
+					servers = append(servers, server)
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Stand in for spartan, answering every query.
+			for _, server := range servers {
+				defer server.Close()
+
+				go func(server net.PacketConn) {
+					buf := make([]byte, 512)
+					for {
+						n, addr, err := server.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+
+						buf[2] |= 0x80
+						server.WriteTo(buf[:n], addr)
+					}
+				}(server)
+			}
+
+			conf := chainedConf("0.4.0", map[string]interface{}{
+				"spartan": map[string]interface{}{
+					"probe": map[string]interface{}{"policy": policy, "timeout": 200},
+				},
+				"minuteman": json.RawMessage(`{ "enable": false }`),
+			})
+
+			targetNS, err := testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+			defer targetNS.Close()
+
+			args := &skel.CmdArgs{
+				ContainerID: "probe",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			By("Invoking ADD")
+			err = originalNS.Do(func(ns.NetNS) error {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+
+			if !succeed {
+				Expect(err).To(HaveOccurred())
+
+				cniErr, ok := err.(*types.Error)
+				Expect(ok).To(BeTrue())
+				Expect(cniErr.Code).To(Equal(cnierrors.ErrNameserverUnreachable))
+
+				By("Checking that the spartan network has been rolled back")
+				err = targetNS.Do(func(ns.NetNS) error {
+					_, err := netlink.LinkByName(spartan.IfName)
+					return err
+				})
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Invoking DEL")
+			err = originalNS.Do(func(ns.NetNS) error {
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("Spartan answers", spartan.ProbeFail, true, true),
+		Entry("Spartan doesn't answer, with a warning", spartan.ProbeWarn, false, true),
+		Entry("Spartan doesn't answer, failing ADD", spartan.ProbeFail, false, false),
+	)
+
+	Describe("STATUS", func() {
+		var (
+			args     *skel.CmdArgs
+			path     string
+			statusNS ns.NetNS
+		)
+
+		BeforeEach(func() {
+			var err error
+			path, err = ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+
+			// STATUS looks at the host's spartan interface and IP
+			// forwarding, which the test sets up in a network namespace
+			// of its own.
+			statusNS, err = testutils.NewNS()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = statusNS.Do(func(ns.NetNS) error {
+				if err := spartan.NewNetConf().CreateHostInterface(); err != nil {
+					return err
+				}
+
+				_, err := sysctl.Sysctl("net/ipv4/ip_forward", "1")
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := l4lbConf("1.1.0", map[string]interface{}{
+				"minuteman": map[string]interface{}{"enable": true, "path": path},
+			})
+
+			args = &skel.CmdArgs{
+				Path:      os.Getenv("PATH"),
+				StdinData: []byte(conf),
+			}
+		})
+
+		AfterEach(func() {
+			Expect(statusNS.Close()).To(Succeed())
+			Expect(os.RemoveAll(path)).To(Succeed())
+			Expect(os.RemoveAll(path + ".state")).To(Succeed())
+		})
+
+		status := func() error {
+			return statusNS.Do(func(ns.NetNS) error {
+				return testutils.CmdStatus(func() error {
+					return cmdStatus(args)
+				})
+			})
+		}
+
+		expectCode := func(err error, code uint) {
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(code))
+		}
+
+		It("Reports the plugin as ready", func() {
+			Expect(status()).To(Succeed())
+		})
+
+		It("Reports plugins missing from CNI_PATH", func() {
+			args.Path = "/nonexistent"
+			expectCode(status(), cnierrors.ErrPluginNotAvailable)
+		})
+
+		It("Reports spartan IPs missing from the spartan interface", func() {
+			err := statusNS.Do(func(ns.NetNS) error {
+				link, err := netlink.LinkByName(spartanHostIfName)
+				if err != nil {
+					return err
+				}
+
+				return netlink.AddrDel(link, &netlink.Addr{IPNet: &spartan.IPs[0]})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			expectCode(status(), cnierrors.ErrLimitedConnectivity)
+		})
+
+		It("Reports the plugin as ready without a host interface that ADD creates", func() {
+			args.StdinData = []byte(l4lbConf("1.1.0", map[string]interface{}{
+				"spartan":   map[string]interface{}{"hostInterface": spartan.HostInterfaceCreate},
+				"minuteman": map[string]interface{}{"enable": true, "path": path},
+			}))
+
+			err := statusNS.Do(func(ns.NetNS) error {
+				return ip.DelLinkByName(spartanHostIfName)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(status()).To(Succeed())
+		})
+
+		It("Reports the plugin as ready with IP forwarding disabled, and leaves it so", func() {
+			err := statusNS.Do(func(ns.NetNS) error {
+				_, err := sysctl.Sysctl("net/ipv4/ip_forward", "0")
+				return err
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(status()).To(Succeed())
+
+			err = statusNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+
+				value, err := sysctl.Sysctl("net/ipv4/ip_forward")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.TrimSpace(value)).To(Equal("0"))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
 })
@@ -0,0 +1,13 @@
+package cnierrors_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCnierrors(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cnierrors Suite")
+}
@@ -0,0 +1,94 @@
+package cnierrors_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func code(err error) uint {
+	cniErr, ok := err.(*types.Error)
+	Expect(ok).To(BeTrue(), "expected a CNI error, got %T", err)
+	return cniErr.Code
+}
+
+var _ = Describe("Cnierrors", func() {
+	Describe("Wrapping errors", func() {
+		It("Uses the given code for plain errors", func() {
+			err := cnierrors.Wrap(errors.New("boom"), cnierrors.ErrIOFailure, "failed to write")
+			Expect(code(err)).To(Equal(cnierrors.ErrIOFailure))
+			Expect(err.(*types.Error).Msg).To(Equal("failed to write"))
+			Expect(err.(*types.Error).Details).To(Equal("boom"))
+		})
+
+		It("Keeps the code of CNI errors", func() {
+			inner := cnierrors.New(cnierrors.ErrNetnsMissing, "netns gone", "details")
+			err := cnierrors.Wrap(inner, cnierrors.ErrInternal, "failed to attach")
+			Expect(code(err)).To(Equal(cnierrors.ErrNetnsMissing))
+			Expect(err.(*types.Error).Msg).To(Equal("failed to attach: netns gone"))
+			Expect(err.(*types.Error).Details).To(Equal("details"))
+		})
+
+		It("Replaces the code of CNI errors without a specific code", func() {
+			inner := cnierrors.New(cnierrors.ErrInternal, "unknown", "")
+			err := cnierrors.Wrap(inner, cnierrors.ErrIOFailure, "failed to write")
+			Expect(code(err)).To(Equal(cnierrors.ErrIOFailure))
+		})
+
+		It("Returns nil for nil errors", func() {
+			Expect(cnierrors.Wrap(nil, cnierrors.ErrInternal, "nothing")).To(BeNil())
+		})
+	})
+
+	Describe("Classifying errors", func() {
+		It("Reports delegate failures", func() {
+			inner := types.NewError(types.ErrInvalidNetworkConfig, "bad bridge config", "")
+			Expect(code(cnierrors.Delegate(inner, "delegate failed"))).To(Equal(cnierrors.ErrDelegateFailure))
+		})
+
+		It("Passes on incompatible versions from the delegate", func() {
+			inner := types.NewError(types.ErrIncompatibleCNIVersion, "incompatible CNI versions", "")
+			Expect(code(cnierrors.Delegate(inner, "delegate failed"))).To(Equal(cnierrors.ErrIncompatibleCNIVersion))
+		})
+
+		It("Reports IPAM exhaustion", func() {
+			inner := types.NewError(types.ErrInternal, "failed to allocate for range 0: no IP addresses available in range set: 198.51.100.10-198.51.100.253", "")
+			Expect(code(cnierrors.IPAM(inner, "failed to get IP address"))).To(Equal(cnierrors.ErrIPAMExhausted))
+		})
+
+		It("Keeps the code returned by the IPAM plugin", func() {
+			inner := types.NewError(types.ErrTryAgainLater, "no IP addresses available until leases expire", "")
+			Expect(code(cnierrors.IPAM(inner, "failed to get IP address"))).To(Equal(types.ErrTryAgainLater))
+
+			exhausted := cnierrors.New(cnierrors.ErrIPAMExhausted, "failed to allocate", "")
+			Expect(code(cnierrors.IPAM(exhausted, "failed to get IP address"))).To(Equal(cnierrors.ErrIPAMExhausted))
+		})
+
+		It("Reports other IPAM failures", func() {
+			Expect(code(cnierrors.IPAM(errors.New("boom"), "failed to get IP address"))).To(Equal(cnierrors.ErrIPAMFailure))
+		})
+
+		It("Reports interface conflicts", func() {
+			Expect(code(cnierrors.Link(syscall.EEXIST, "failed to add route"))).To(Equal(cnierrors.ErrInterfaceConflict))
+			Expect(code(cnierrors.Link(fmt.Errorf("container veth name (%q) peer provided (%q) already exists", "spartan", "veth0"), "failed to add veth"))).To(Equal(cnierrors.ErrInterfaceConflict))
+		})
+
+		It("Reports other netlink failures", func() {
+			Expect(code(cnierrors.Link(syscall.EPERM, "failed to add route"))).To(Equal(cnierrors.ErrInterfaceFailure))
+		})
+
+		It("Reports missing network namespaces", func() {
+			_, err := ns.GetNS("/var/run/netns/does-not-exist")
+			Expect(err).To(HaveOccurred())
+			Expect(code(cnierrors.Netns(err, "failed to enter netns"))).To(Equal(cnierrors.ErrNetnsMissing))
+		})
+	})
+})
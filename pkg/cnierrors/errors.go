@@ -0,0 +1,130 @@
+// Package cnierrors defines the CNI errors returned by the DC/OS CNI
+// plugins. Every error carries a code, so that the runtime can tell a
+// configuration problem, which will fail again on retry, from a failure
+// in the delegate plugin, the IPAM plugin or the kernel.
+package cnierrors
+
+import (
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// Codes defined by the CNI spec.
+const (
+	ErrIncompatibleCNIVersion = types.ErrIncompatibleCNIVersion
+	ErrDecodingFailure        = types.ErrDecodingFailure
+	ErrIOFailure              = types.ErrIOFailure
+	ErrInvalidConfig          = types.ErrInvalidNetworkConfig
+	ErrNetnsMissing           = types.ErrInvalidNetNS
+	ErrInternal               = types.ErrInternal
+)
+
+// Codes defined by the CNI spec for STATUS. The CNI library we build
+// against predates them, so there is nothing to alias.
+const (
+	// The plugin cannot serve ADD.
+	ErrPluginNotAvailable uint = 50
+	// The plugin cannot serve ADD, and containers already attached to
+	// the network might have lost connectivity.
+	ErrLimitedConnectivity uint = 51
+)
+
+// Codes specific to the DC/OS CNI plugins. The CNI spec reserves codes
+// below 100 for itself.
+const (
+	// The delegate plugin failed.
+	ErrDelegateFailure uint = 100 + iota
+	// The IPAM plugin failed for reasons other than running out of
+	// addresses.
+	ErrIPAMFailure
+	// The IPAM plugin has no addresses left to allocate.
+	ErrIPAMExhausted
+	// An interface, address or route that we need already exists.
+	ErrInterfaceConflict
+	// Setting up, checking or tearing down an interface failed.
+	ErrInterfaceFailure
+	// The container can't reach the spartan nameservers once attached to
+	// the spartan network.
+	ErrNameserverUnreachable
+	// Setting up, checking or tearing down firewall rules failed.
+	ErrFirewallFailure
+)
+
+// New returns a CNI error with the given code, message and details.
+func New(code uint, msg, details string) error {
+	return types.NewError(code, msg, details)
+}
+
+// Wrap returns `err` as a CNI error with the given code, using `msg` as
+// the message and `err` as the details. If `err` already is a CNI error
+// with a specific code, that code is kept and `msg` is only prepended to
+// its message, so that the code set closest to the failure wins.
+func Wrap(err error, code uint, msg string) error {
+	if err == nil {
+		return nil
+	}
+
+	if e, ok := err.(*types.Error); ok && e.Code != types.ErrUnknown && e.Code != types.ErrInternal {
+		return &types.Error{
+			Code:    e.Code,
+			Msg:     msg + ": " + e.Msg,
+			Details: e.Details,
+		}
+	}
+
+	return types.NewError(code, msg, err.Error())
+}
+
+// Delegate wraps a failure of the delegate plugin. Version mismatches are
+// passed on as such, every other failure is reported as a delegate
+// failure with the delegate's own error in the details.
+func Delegate(err error, msg string) error {
+	if e, ok := err.(*types.Error); ok && e.Code == types.ErrIncompatibleCNIVersion {
+		return Wrap(err, ErrIncompatibleCNIVersion, msg)
+	}
+
+	return New(ErrDelegateFailure, msg, err.Error())
+}
+
+// IPAM wraps a failure of an IPAM plugin, telling an exhausted address
+// range apart from other failures. A specific code returned by the IPAM
+// plugin is kept, such as a version mismatch or `ErrIPAMExhausted` from
+// an earlier call to `IPAM`.
+func IPAM(err error, msg string) error {
+	if e, ok := err.(*types.Error); ok && e.Code != types.ErrUnknown && e.Code != types.ErrInternal {
+		return Wrap(err, ErrIPAMFailure, msg)
+	}
+
+	// host-local reports running out of addresses as an internal error,
+	// so that only its message tells.
+	if strings.Contains(err.Error(), "no IP addresses available") {
+		return New(ErrIPAMExhausted, msg, err.Error())
+	}
+
+	return Wrap(err, ErrIPAMFailure, msg)
+}
+
+// Link wraps a netlink failure, telling an interface, address or route
+// that already exists apart from other failures.
+func Link(err error, msg string) error {
+	if os.IsExist(err) || strings.Contains(err.Error(), "already exists") {
+		return Wrap(err, ErrInterfaceConflict, msg)
+	}
+
+	return Wrap(err, ErrInterfaceFailure, msg)
+}
+
+// Netns wraps a failure while operating within a network namespace,
+// telling a network namespace that doesn't exist apart from failures
+// within the namespace.
+func Netns(err error, msg string) error {
+	switch err.(type) {
+	case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		return Wrap(err, ErrNetnsMissing, msg)
+	}
+
+	return Wrap(err, ErrInterfaceFailure, msg)
+}
@@ -6,24 +6,23 @@ import (
 
 	"github.com/containernetworking/cni/pkg/types"
 
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
 	"github.com/dcos/dcos-cni/pkg/minuteman"
 	"github.com/dcos/dcos-cni/pkg/spartan"
 )
 
 type NetConf struct {
 	types.NetConf
-	Spartan   *spartan.NetConf       `json:"spartan, omitempty"`
-	Minuteman *minuteman.NetConf     `json:"minuteman, omitempty"`
-	Args      map[string]interface{} `json:"args, omitempty"`
-	MTU       int                    `json:"mtu, omitempty"`
-	Delegate  map[string]interface{} `json:"delegate, omitempty"`
+	Spartan   *spartan.NetConf       `json:"spartan,omitempty"`
+	Minuteman *minuteman.NetConf     `json:"minuteman,omitempty"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+	MTU       int                    `json:"mtu,omitempty"`
+	Delegate  map[string]interface{} `json:"delegate,omitempty"`
 }
 
 func NewNetConf() *NetConf {
 	conf := &NetConf{
-		Spartan: &spartan.NetConf{
-			Enable: true,
-		},
+		Spartan: spartan.NewNetConf(),
 
 		Minuteman: &minuteman.NetConf{
 			Enable: true,
@@ -33,26 +32,55 @@ func NewNetConf() *NetConf {
 	return conf
 }
 
+// Chained returns true when the plugin runs as part of a chain of plugins
+// in a `.conflist`, augmenting the `prevResult` of the previous plugin
+// instead of wrapping a `delegate` plugin.
+func (conf *NetConf) Chained() bool {
+	return conf.Delegate == nil
+}
+
 func (conf *NetConf) SetupDelegateConf() (delegateConf []byte, delegatePlugin string, err error) {
+	if conf.Delegate == nil {
+		err = cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("no delegate network specified for network: %s", conf.Name), "")
+		return
+	}
+
 	conf.Delegate["name"] = conf.Name
 	conf.Delegate["cniVersion"] = conf.CNIVersion
 	conf.Delegate["args"] = conf.Args
 
+	// The runtime hands us the result of a previous ADD during CHECK and
+	// DEL, and the delegate needs to see it to validate its own state.
+	if conf.RawPrevResult != nil {
+		conf.Delegate["prevResult"] = conf.RawPrevResult
+	}
+
+	// The delegate's own MTU takes precedence over ours.
+	if _, ok := conf.Delegate["mtu"]; !ok && conf.MTU > 0 {
+		conf.Delegate["mtu"] = conf.MTU
+	}
+
+	// During GC the delegate needs to know which of its attachments are
+	// still in use.
+	if conf.ValidAttachments != nil {
+		conf.Delegate["cni.dev/valid-attachments"] = conf.ValidAttachments
+	}
+
 	delegateConf, err = json.Marshal(conf.Delegate)
 	if err != nil {
-		err = fmt.Errorf("failed to marshall the delegate configuration: %s", err)
+		err = cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshall the delegate configuration")
 		return
 	}
 
 	plugin, ok := conf.Delegate["type"]
 	if !ok {
-		err = fmt.Errorf("'type' field missing in delegate network: %s", conf.Delegate["name"])
+		err = cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("'type' field missing in delegate network: %s", conf.Delegate["name"]), "")
 		return
 	}
 
 	delegatePlugin, ok = plugin.(string)
 	if !ok {
-		err = fmt.Errorf("'type' field in delegate network %s has incorrect type, expected a `string`", conf.Delegate["name"])
+		err = cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("'type' field in delegate network %s has incorrect type, expected a `string`", conf.Delegate["name"]), "")
 	}
 
 	return
@@ -0,0 +1,13 @@
+package l4lb_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestL4lb(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "L4lb Suite")
+}
@@ -0,0 +1,243 @@
+package l4lb_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+
+	"github.com/dcos/dcos-cni/pkg/l4lb"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types020 "github.com/containernetworking/cni/pkg/types/020"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("L4lb", func() {
+	var (
+		delegateResult *current.Result
+		spartanResult  *current.Result
+	)
+
+	BeforeEach(func() {
+		delegateResult = &current.Result{
+			CNIVersion: current.ImplementedSpecVersion,
+			Interfaces: []*current.Interface{
+				{Name: "mesos-cni0"},
+				{Name: "veth0"},
+				{Name: "eth0", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{
+				{
+					Interface: current.Int(2),
+					Address:   net.IPNet{IP: net.ParseIP("10.1.2.5"), Mask: net.CIDRMask(24, 32)},
+				},
+			},
+			Routes: []*types.Route{
+				{Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}},
+			},
+		}
+
+		spartanResult = &current.Result{
+			CNIVersion: current.ImplementedSpecVersion,
+			Interfaces: []*current.Interface{
+				{Name: "vethspartan"},
+				{Name: "spartan", Sandbox: "/var/run/netns/test"},
+			},
+			IPs: []*current.IPConfig{
+				{
+					Interface: current.Int(1),
+					Address:   net.IPNet{IP: net.ParseIP("198.51.100.10"), Mask: net.CIDRMask(32, 32)},
+				},
+			},
+			Routes: []*types.Route{
+				{Dst: net.IPNet{IP: net.ParseIP("198.51.100.1"), Mask: net.CIDRMask(32, 32)}},
+			},
+		}
+	})
+
+	Describe("Merging results", func() {
+		It("Appends interfaces, IPs and routes and re-indexes the IPs", func() {
+			l4lb.MergeResult(delegateResult, spartanResult)
+
+			Expect(delegateResult.Interfaces).To(HaveLen(5))
+			Expect(delegateResult.Interfaces[4].Name).To(Equal("spartan"))
+
+			Expect(delegateResult.IPs).To(HaveLen(2))
+			Expect(*delegateResult.IPs[0].Interface).To(Equal(2))
+			Expect(*delegateResult.IPs[1].Interface).To(Equal(4))
+
+			Expect(delegateResult.Routes).To(HaveLen(2))
+
+			// The merged result must not alias the spartan result.
+			Expect(*spartanResult.IPs[0].Interface).To(Equal(1))
+		})
+	})
+
+	Describe("Unmerging results", func() {
+		It("Leaves the result that was merged into", func() {
+			original, err := json.Marshal(delegateResult)
+			Expect(err).NotTo(HaveOccurred())
+
+			l4lb.MergeResult(delegateResult, spartanResult)
+
+			// Interfaces and routes are matched without their other
+			// details.
+			result := l4lb.UnmergeResult(delegateResult, &current.Result{
+				Interfaces: []*current.Interface{
+					{Name: "vethspartan"},
+					{Name: "spartan", Sandbox: "/var/run/netns/test"},
+				},
+				Routes: []*types.Route{
+					{Dst: net.IPNet{IP: net.ParseIP("198.51.100.1"), Mask: net.CIDRMask(32, 32)}},
+				},
+			})
+
+			unmerged, err := json.Marshal(result)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unmerged).To(MatchJSON(original))
+		})
+	})
+
+	Describe("Converting results", func() {
+		DescribeTable("Converts a merged result to an older CNI version keeping the delegate's IPs",
+			func(delegateIP6, spartanIP6 string) {
+				if delegateIP6 != "" {
+					delegateResult.IPs = append(delegateResult.IPs, &current.IPConfig{
+						Interface: current.Int(2),
+						Address:   net.IPNet{IP: net.ParseIP(delegateIP6), Mask: net.CIDRMask(64, 128)},
+					})
+				}
+
+				if spartanIP6 != "" {
+					spartanResult.IPs = append(spartanResult.IPs, &current.IPConfig{
+						Interface: current.Int(1),
+						Address:   net.IPNet{IP: net.ParseIP(spartanIP6), Mask: net.CIDRMask(128, 128)},
+					})
+				}
+
+				l4lb.MergeResult(delegateResult, spartanResult)
+
+				result, err := l4lb.ConvertMergedResult(delegateResult, spartanResult, "0.2.0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Version()).To(Equal("0.2.0"))
+
+				result020, ok := result.(*types020.Result)
+				Expect(ok).To(BeTrue())
+				Expect(result020.IP4.IP.IP.String()).To(Equal("10.1.2.5"))
+
+				if delegateIP6 == "" {
+					Expect(result020.IP6).To(BeNil())
+				} else {
+					Expect(result020.IP6).NotTo(BeNil())
+					Expect(result020.IP6.IP.IP.String()).To(Equal(delegateIP6))
+				}
+			},
+			Entry("IPv4", "", ""),
+			Entry("Dual-stack spartan network", "", "fd00:5::10"),
+			Entry("Dual-stack delegate and spartan network", "fd00:1::5", "fd00:5::10"),
+		)
+
+		It("Keeps the spartan network in a merged result of a recent CNI version", func() {
+			l4lb.MergeResult(delegateResult, spartanResult)
+
+			result, err := l4lb.ConvertMergedResult(delegateResult, spartanResult, "0.4.0")
+			Expect(err).NotTo(HaveOccurred())
+
+			result040, err := current.NewResultFromResult(result)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result040.IPs).To(HaveLen(2))
+		})
+
+		It("Treats a missing cniVersion as 0.1.0", func() {
+			result, err := l4lb.ConvertResult(delegateResult, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Version()).To(Equal("0.1.0"))
+		})
+
+		It("Reports results that can't be converted as incompatible versions", func() {
+			delegateResult.IPs = nil
+
+			_, err := l4lb.ConvertResult(delegateResult, "0.2.0")
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(types.ErrIncompatibleCNIVersion))
+		})
+
+		It("Reports unknown versions as incompatible versions", func() {
+			_, err := l4lb.ConvertResult(delegateResult, "9.9.9")
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(types.ErrIncompatibleCNIVersion))
+		})
+	})
+
+	Describe("Printing results", func() {
+		It("Adds the extensions to the result", func() {
+			var buf bytes.Buffer
+			extensions := map[string]interface{}{l4lb.ResolvConfKey: "/run/resolv/test/resolv.conf"}
+			Expect(l4lb.PrintResult(&buf, delegateResult, extensions)).To(Succeed())
+
+			printed := map[string]interface{}{}
+			Expect(json.Unmarshal(buf.Bytes(), &printed)).To(Succeed())
+			Expect(printed).To(HaveKeyWithValue(l4lb.ResolvConfKey, "/run/resolv/test/resolv.conf"))
+
+			result, err := current.NewResult(buf.Bytes())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(delegateResult))
+		})
+
+		It("Prints the plain result without extensions", func() {
+			var buf, plain bytes.Buffer
+			Expect(l4lb.PrintResult(&buf, delegateResult, nil)).To(Succeed())
+			Expect(delegateResult.PrintTo(&plain)).To(Succeed())
+			Expect(buf.String()).To(Equal(plain.String()))
+		})
+	})
+
+	Describe("Setting up the delegate configuration", func() {
+		It("Hands the valid attachments to the delegate during GC", func() {
+			conf := l4lb.NewNetConf()
+			conf.Name = "spartan-net"
+			conf.CNIVersion = "1.1.0"
+			conf.Delegate = map[string]interface{}{"type": "bridge"}
+			conf.ValidAttachments = []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}}
+
+			delegateConf, delegatePlugin, err := conf.SetupDelegateConf()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(delegatePlugin).To(Equal("bridge"))
+
+			gcConf := types.NetConf{}
+			Expect(json.Unmarshal(delegateConf, &gcConf)).To(Succeed())
+			Expect(gcConf.Name).To(Equal("spartan-net"))
+			Expect(gcConf.ValidAttachments).To(Equal(conf.ValidAttachments))
+		})
+
+		It("Forwards the MTU to the delegate", func() {
+			conf := l4lb.NewNetConf()
+			conf.MTU = 1420
+			conf.Delegate = map[string]interface{}{"type": "bridge"}
+
+			delegateConf, _, err := conf.SetupDelegateConf()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(delegateConf)).To(ContainSubstring(`"mtu":1420`))
+		})
+
+		It("Keeps the delegate's own MTU", func() {
+			conf := l4lb.NewNetConf()
+			conf.MTU = 1420
+			conf.Delegate = map[string]interface{}{"type": "bridge", "mtu": 9000}
+
+			delegateConf, _, err := conf.SetupDelegateConf()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(delegateConf)).To(ContainSubstring(`"mtu":9000`))
+		})
+	})
+})
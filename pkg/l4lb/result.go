@@ -0,0 +1,176 @@
+package l4lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+)
+
+// MergeResult appends the interfaces, IPs and routes of `other` to
+// `result`. The IPs of `other` are re-indexed so that they keep pointing
+// at their own interfaces once those have been appended to `result`. The
+// DNS configuration of `result` is left untouched.
+func MergeResult(result, other *current.Result) {
+	offset := len(result.Interfaces)
+
+	for _, iface := range other.Interfaces {
+		result.Interfaces = append(result.Interfaces, iface.Copy())
+	}
+
+	for _, ipc := range other.IPs {
+		ipc = ipc.Copy()
+		if ipc.Interface != nil {
+			ipc.Interface = current.Int(*ipc.Interface + offset)
+		}
+
+		result.IPs = append(result.IPs, ipc)
+	}
+
+	for _, route := range other.Routes {
+		result.Routes = append(result.Routes, route.Copy())
+	}
+}
+
+// UnmergeResult undoes `MergeResult`, returning a copy of `result` without
+// the interfaces and routes of `other`, and without the IPs assigned to
+// those interfaces. Interfaces are matched by name and sandbox, and routes
+// by destination and gateway, so `other` only has to describe them. The
+// remaining IPs are re-indexed to keep pointing at their own interfaces.
+func UnmergeResult(result, other *current.Result) *current.Result {
+	unmerged := &current.Result{
+		CNIVersion: result.CNIVersion,
+		DNS:        result.DNS,
+	}
+
+	// The index of each remaining interface in `unmerged`, by its index
+	// in `result`.
+	indexes := map[int]int{}
+	for i, iface := range result.Interfaces {
+		removed := false
+		for _, otherIface := range other.Interfaces {
+			if iface.Name == otherIface.Name && iface.Sandbox == otherIface.Sandbox {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			indexes[i] = len(unmerged.Interfaces)
+			unmerged.Interfaces = append(unmerged.Interfaces, iface.Copy())
+		}
+	}
+
+	for _, ipc := range result.IPs {
+		ipc = ipc.Copy()
+		if ipc.Interface != nil {
+			index, ok := indexes[*ipc.Interface]
+			if !ok {
+				continue
+			}
+
+			ipc.Interface = current.Int(index)
+		}
+
+		unmerged.IPs = append(unmerged.IPs, ipc)
+	}
+
+	for _, route := range result.Routes {
+		removed := false
+		for _, otherRoute := range other.Routes {
+			if route.Dst.String() == otherRoute.Dst.String() && route.GW.Equal(otherRoute.GW) {
+				removed = true
+				break
+			}
+		}
+
+		if !removed {
+			unmerged.Routes = append(unmerged.Routes, route.Copy())
+		}
+	}
+
+	return unmerged
+}
+
+// ConvertResult converts `result` to the CNI spec version requested by
+// the runtime. A result that can't be expressed in that version is
+// reported as an incompatible CNI version error, rather than an opaque
+// failure.
+func ConvertResult(result types.Result, cniVersion string) (types.Result, error) {
+	// A configuration without a `cniVersion` is a 0.1.0 configuration.
+	if cniVersion == "" {
+		cniVersion = "0.1.0"
+	}
+
+	converted, err := result.GetAsVersion(cniVersion)
+	if err != nil {
+		return nil, cnierrors.New(
+			cnierrors.ErrIncompatibleCNIVersion,
+			fmt.Sprintf("cannot convert a version %s result to cniVersion %s", result.Version(), cniVersion),
+			err.Error())
+	}
+
+	return converted, nil
+}
+
+// ConvertMergedResult converts `result`, into which `other` has been
+// merged with `MergeResult`, to the CNI spec version requested by the
+// runtime. Results before 0.3.0 have no interfaces, and room for a single
+// address per family, which has to be the delegate's. So `other` is
+// unmerged first when converting to such a version, lest one of its
+// addresses take the place of the delegate's.
+func ConvertMergedResult(result, other *current.Result, cniVersion string) (types.Result, error) {
+	if other == nil {
+		return ConvertResult(result, cniVersion)
+	}
+
+	// A configuration without a `cniVersion` is a 0.1.0 configuration.
+	if cniVersion == "" {
+		cniVersion = "0.1.0"
+	}
+
+	if interfaces, err := version.GreaterThanOrEqualTo(cniVersion, "0.3.0"); err == nil && !interfaces {
+		return ConvertResult(UnmergeResult(result, other), cniVersion)
+	}
+
+	return ConvertResult(result, cniVersion)
+}
+
+// ResolvConfKey is the key under which the result carries the path of the
+// resolv.conf written for the container, if any.
+const ResolvConfKey = "dcos.io/resolvConf"
+
+// PrintResult writes `result` to `w` like `types.Result.PrintTo`, adding
+// the keys of `extensions` that the CNI result has no field for.
+func PrintResult(w io.Writer, result types.Result, extensions map[string]interface{}) error {
+	if len(extensions) == 0 {
+		return result.PrintTo(w)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to marshal the result")
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to unmarshal the result")
+	}
+
+	for key, value := range extensions {
+		fields[key] = value
+	}
+
+	data, err = json.MarshalIndent(fields, "", "    ")
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInternal, "failed to marshal the result")
+	}
+
+	_, err = w.Write(data)
+	return err
+}
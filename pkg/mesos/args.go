@@ -0,0 +1,53 @@
+package mesos
+
+import (
+	"encoding/json"
+)
+
+// ArgsKey is the key of the CNI `args` under which Mesos passes the
+// `NetworkInfo` of the container.
+const ArgsKey = "org.apache.mesos"
+
+// networkInfo is the part of the `NetworkInfo` protobuf, in its JSON
+// form, that we care about.
+type networkInfo struct {
+	Name   string `json:"name,omitempty"`
+	Labels struct {
+		Labels []struct {
+			Key   string `json:"key"`
+			Value string `json:"value,omitempty"`
+		} `json:"labels,omitempty"`
+	} `json:"labels,omitempty"`
+}
+
+// Labels returns the labels of the network that Mesos attached the
+// container to, as found in the `args` of a CNI network configuration.
+// Configurations that don't come from Mesos have no labels.
+func Labels(args map[string]interface{}) map[string]string {
+	mesosArgs, ok := args[ArgsKey].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	// Go through JSON rather than walking nested maps by hand.
+	data, err := json.Marshal(mesosArgs["network_info"])
+	if err != nil {
+		return nil
+	}
+
+	info := networkInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil
+	}
+
+	if len(info.Labels.Labels) == 0 {
+		return nil
+	}
+
+	labels := map[string]string{}
+	for _, label := range info.Labels.Labels {
+		labels[label.Key] = label.Value
+	}
+
+	return labels
+}
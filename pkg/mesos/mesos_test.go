@@ -3,6 +3,7 @@ package mesos_test
 import (
 	"github.com/dcos/dcos-cni/pkg/mesos"
 
+	"encoding/json"
 	"net"
 	"os"
 
@@ -76,4 +77,31 @@ var _ = Describe("Mesos", func() {
 
 	})
 
+	Describe("Testing network labels", func() {
+		It("Reads the labels of the Mesos network", func() {
+			args := map[string]interface{}{}
+			err := json.Unmarshal([]byte(`{
+				"org.apache.mesos": {
+					"network_info": {
+						"name": "dcos",
+						"labels": {
+							"labels": [
+								{ "key": "app", "value": "web" },
+								{ "key": "canary" }
+							]
+						}
+					}
+				}
+			}`), &args)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(mesos.Labels(args)).To(Equal(map[string]string{"app": "web", "canary": ""}))
+		})
+
+		It("Has no labels outside of Mesos", func() {
+			Expect(mesos.Labels(nil)).To(BeNil())
+			Expect(mesos.Labels(map[string]interface{}{"IgnoreUnknown": true})).To(BeNil())
+		})
+	})
+
 })
@@ -1,6 +1,39 @@
 package minuteman
 
+import (
+	"github.com/containernetworking/cni/pkg/types"
+)
+
 type NetConf struct {
-	Enable bool   `json:"enable", omitempty"`
-	Path   string `json:"path, omitempty"`
+	Enable bool   `json:"enable,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// The format of the registration records, `json` or `legacy`.
+	Format string `json:"format,omitempty"`
+	// The endpoint notified of registrations, in addition to the
+	// registration records.
+	Notify NotifyConf `json:"notify,omitempty"`
+	// The VIPs assigned to the minuteman interface.
+	VIPs []types.IPNet `json:"vips,omitempty"`
+	// A file listing more VIPs, one per line.
+	VIPFile string `json:"vipFile,omitempty"`
+}
+
+// NotifyConf controls how minuteman is notified of containers being
+// registered and de-registered. Notifications are disabled unless either
+// `URL` or `Socket` is set.
+type NotifyConf struct {
+	// The HTTP URL to POST events to.
+	URL string `json:"url,omitempty"`
+	// A Unix socket to send the requests to, instead of the host of `URL`.
+	Socket string `json:"socket,omitempty"`
+	// How long to wait for each attempt, in milliseconds.
+	Timeout int `json:"timeout,omitempty"`
+	// How many times to retry a failed attempt.
+	Retries int `json:"retries,omitempty"`
+	// How long to wait before the first retry, in milliseconds. The wait
+	// doubles with every retry, up to `MaxNotifyBackoff`.
+	Backoff int `json:"backoff,omitempty"`
+	// How long to spend notifying minuteman of an event in total, retries
+	// included, in milliseconds.
+	Deadline int `json:"deadline,omitempty"`
 }
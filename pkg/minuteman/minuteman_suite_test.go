@@ -0,0 +1,13 @@
+package minuteman_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMinuteman(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Minuteman Suite")
+}
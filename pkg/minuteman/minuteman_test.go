@@ -0,0 +1,538 @@
+package minuteman_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+	"github.com/dcos/dcos-cni/pkg/minuteman"
+	"github.com/dcos/dcos-cni/pkg/registry"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Minuteman", func() {
+	Describe("Garbage collection", func() {
+		var (
+			path string
+			args *skel.CmdArgs
+		)
+
+		BeforeEach(func() {
+			var err error
+			path, err = ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+
+			stdinData, err := json.Marshal(&minuteman.NetConf{Enable: true, Path: path})
+			Expect(err).NotTo(HaveOccurred())
+			args = &skel.CmdArgs{StdinData: stdinData}
+
+			networks := map[string]string{"live": "dcos", "stale": "dcos", "other": "other"}
+			for containerID, network := range networks {
+				record, err := json.Marshal(&minuteman.Registration{
+					Version:     minuteman.RegistrationVersion,
+					ContainerID: containerID,
+					Netns:       "/var/run/netns/" + containerID,
+					Network:     network,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(path, containerID), record, 0644)).To(Succeed())
+			}
+
+			Expect(ioutil.WriteFile(filepath.Join(path, "legacy"), []byte("/var/run/netns/legacy"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(path)).To(Succeed())
+			Expect(os.RemoveAll(path + ".state")).To(Succeed())
+		})
+
+		It("Removes the registrations of unknown containers on the network", func() {
+			err := minuteman.CniGC(args, "dcos", []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(path, "live")).To(BeAnExistingFile())
+			Expect(filepath.Join(path, "stale")).NotTo(BeAnExistingFile())
+		})
+
+		It("Leaves the registrations of other networks alone", func() {
+			Expect(minuteman.CniGC(args, "dcos", nil)).To(Succeed())
+
+			Expect(filepath.Join(path, "other")).To(BeAnExistingFile())
+			Expect(filepath.Join(path, "legacy")).To(BeAnExistingFile())
+		})
+
+		It("Removes legacy registrations of unknown containers on a network writing them", func() {
+			stdinData, err := json.Marshal(&minuteman.NetConf{Enable: true, Path: path, Format: minuteman.FormatLegacy})
+			Expect(err).NotTo(HaveOccurred())
+			args.StdinData = stdinData
+
+			Expect(minuteman.CniGC(args, "dcos", nil)).To(Succeed())
+
+			Expect(filepath.Join(path, "legacy")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(path, "other")).To(BeAnExistingFile())
+		})
+
+		It("Does nothing without a registration directory", func() {
+			Expect(os.RemoveAll(path)).To(Succeed())
+			Expect(minuteman.CniGC(args, "dcos", nil)).To(Succeed())
+		})
+	})
+
+	Describe("Registration records", func() {
+		var path string
+
+		BeforeEach(func() {
+			var err error
+			path, err = ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(path)).To(Succeed())
+		})
+
+		It("Reads JSON records", func() {
+			record := `{
+				"version": 1,
+				"containerId": "json",
+				"netns": "/var/run/netns/json",
+				"ifName": "eth0",
+				"network": "dcos",
+				"containerIPs": ["9.0.1.5"],
+				"spartanIPs": ["198.51.100.10"],
+				"vips": ["11.0.0.1/32"],
+				"labels": { "app": "web" },
+				"created": "2018-01-02T03:04:05Z",
+				"updated": "2018-01-02T03:04:06Z"
+			}`
+			Expect(ioutil.WriteFile(filepath.Join(path, "json"), []byte(record), 0644)).To(Succeed())
+
+			registration, err := minuteman.ReadRegistration(path, "json")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registration.Version).To(Equal(minuteman.RegistrationVersion))
+			Expect(registration.Netns).To(Equal("/var/run/netns/json"))
+			Expect(registration.IfName).To(Equal("eth0"))
+			Expect(registration.Network).To(Equal("dcos"))
+			Expect(registration.ContainerIPs).To(Equal([]net.IP{net.ParseIP("9.0.1.5")}))
+			Expect(registration.SpartanIPs).To(Equal([]net.IP{net.ParseIP("198.51.100.10")}))
+			Expect(registration.VIPs).To(HaveLen(1))
+			Expect((*net.IPNet)(&registration.VIPs[0]).String()).To(Equal("11.0.0.1/32"))
+			Expect(registration.Labels).To(Equal(map[string]string{"app": "web"}))
+			Expect(registration.Created).To(Equal(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)))
+		})
+
+		It("Reads legacy records", func() {
+			Expect(ioutil.WriteFile(filepath.Join(path, "legacy"), []byte("/var/run/netns/legacy"), 0644)).To(Succeed())
+
+			registration, err := minuteman.ReadRegistration(path, "legacy")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registration.Version).To(BeZero())
+			Expect(registration.ContainerID).To(Equal("legacy"))
+			Expect(registration.Netns).To(Equal("/var/run/netns/legacy"))
+			Expect(registration.Created).NotTo(BeZero())
+		})
+
+		It("Rejects records it doesn't understand", func() {
+			for _, record := range []string{
+				``,
+				`{"version": 2, "containerId": "bad", "netns": "/var/run/netns/bad"}`,
+				`{"version": 1, "containerId": "other", "netns": "/var/run/netns/bad"}`,
+				`{"version": 1, "containerId": "bad"}`,
+				`{"version": 1,`,
+			} {
+				_, err := minuteman.ParseRegistration("bad", []byte(record))
+				Expect(err).To(HaveOccurred(), "accepted %q", record)
+			}
+		})
+
+		It("Lists the records of all containers", func() {
+			Expect(ioutil.WriteFile(filepath.Join(path, "legacy"), []byte("/var/run/netns/legacy"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(path, "json"), []byte(`{"version": 1, "containerId": "json", "netns": "/var/run/netns/json"}`), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(path, ".json-tmp"), []byte(`{`), 0644)).To(Succeed())
+
+			registrations, err := minuteman.ReadRegistrations(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registrations).To(HaveLen(2))
+
+			netns := map[string]string{}
+			for _, registration := range registrations {
+				netns[registration.ContainerID] = registration.Netns
+			}
+			Expect(netns).To(Equal(map[string]string{"json": "/var/run/netns/json", "legacy": "/var/run/netns/legacy"}))
+		})
+
+		It("Has no records without a registration directory", func() {
+			Expect(os.RemoveAll(path)).To(Succeed())
+
+			registrations, err := minuteman.ReadRegistrations(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registrations).To(BeEmpty())
+		})
+	})
+
+	Describe("Notifications", func() {
+		var (
+			path     string
+			requests chan *http.Request
+			events   chan *minuteman.Event
+			statuses []int
+			delay    time.Duration
+		)
+
+		// handler records the events it receives, answering with the
+		// next of `statuses`, or 200 once they run out.
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			event := &minuteman.Event{}
+			Expect(json.NewDecoder(r.Body).Decode(event)).To(Succeed())
+			requests <- r
+			events <- event
+
+			time.Sleep(delay)
+
+			status := http.StatusOK
+			if len(statuses) > 0 {
+				status, statuses = statuses[0], statuses[1:]
+			}
+			w.WriteHeader(status)
+		})
+
+		BeforeEach(func() {
+			var err error
+			path, err = ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+
+			requests = make(chan *http.Request, 10)
+			events = make(chan *minuteman.Event, 10)
+			statuses = nil
+			delay = 0
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(path)).To(Succeed())
+			Expect(os.RemoveAll(path + ".state")).To(Succeed())
+		})
+
+		registration := &minuteman.Registration{
+			Version:     minuteman.RegistrationVersion,
+			ContainerID: "notify",
+			Netns:       "/var/run/netns/notify",
+			Labels:      map[string]string{"app": "web"},
+		}
+
+		It("Posts events to an HTTP endpoint", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			conf := &minuteman.NotifyConf{URL: server.URL + "/events"}
+			Expect(conf.Validate()).To(Succeed())
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration})).To(Succeed())
+
+			r := <-requests
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.URL.Path).To(Equal("/events"))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+			Expect(<-events).To(Equal(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration}))
+		})
+
+		It("Posts events to a Unix socket", func() {
+			socket := filepath.Join(path, "minuteman.sock")
+			listener, err := net.Listen("unix", socket)
+			Expect(err).NotTo(HaveOccurred())
+
+			server := &http.Server{Handler: handler}
+			go server.Serve(listener)
+			defer server.Close()
+
+			conf := &minuteman.NotifyConf{Socket: socket}
+			Expect(conf.Validate()).To(Succeed())
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventDeregister, Registration: registration})).To(Succeed())
+
+			r := <-requests
+			Expect(r.URL.Path).To(Equal("/v1/containers"))
+			Expect((<-events).Type).To(Equal(minuteman.EventDeregister))
+		})
+
+		It("Retries failed attempts", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			statuses = []int{http.StatusServiceUnavailable, http.StatusInternalServerError}
+			conf := &minuteman.NotifyConf{URL: server.URL, Retries: 2, Backoff: 1}
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration})).To(Succeed())
+			Expect(requests).To(HaveLen(3))
+		})
+
+		It("Gives up once out of retries", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+			conf := &minuteman.NotifyConf{URL: server.URL, Retries: 1, Backoff: 1}
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration})).NotTo(Succeed())
+			Expect(requests).To(HaveLen(2))
+		})
+
+		It("Doesn't retry events that minuteman rejects", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			statuses = []int{http.StatusBadRequest}
+			conf := &minuteman.NotifyConf{URL: server.URL, Retries: 3, Backoff: 1}
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration})).NotTo(Succeed())
+			Expect(requests).To(HaveLen(1))
+		})
+
+		It("Times out", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			delay = 200 * time.Millisecond
+			conf := &minuteman.NotifyConf{URL: server.URL, Timeout: 20}
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration})).NotTo(Succeed())
+		})
+
+		It("Gives up at the deadline when minuteman hangs", func() {
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			delay = 200 * time.Millisecond
+			conf := &minuteman.NotifyConf{URL: server.URL, Timeout: 50, Retries: 100, Backoff: 10, Deadline: 100}
+
+			start := time.Now()
+			Expect(conf.Notify(&minuteman.Event{Type: minuteman.EventRegister, Registration: registration})).NotTo(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+
+		It("Rejects invalid endpoints", func() {
+			for _, conf := range []minuteman.NotifyConf{
+				{URL: "unix:///var/run/minuteman.sock"},
+				{URL: "localhost:61421"},
+				{Socket: "/var/run/minuteman.sock", Timeout: -1},
+				{Socket: "/var/run/minuteman.sock", Retries: -1},
+				{Socket: "/var/run/minuteman.sock", Deadline: -1},
+			} {
+				Expect(conf.Validate()).NotTo(Succeed(), "accepted %+v", conf)
+			}
+		})
+
+		It("Notifies minuteman of DEL and falls back to the registration records", func() {
+			server := httptest.NewServer(handler)
+
+			data, err := json.Marshal(registration)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(path, "notify"), data, 0644)).To(Succeed())
+
+			del := func() error {
+				stdinData, err := json.Marshal(&minuteman.NetConf{
+					Enable: true,
+					Path:   path,
+					Notify: minuteman.NotifyConf{URL: server.URL},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				return minuteman.CniDel(&skel.CmdArgs{ContainerID: "notify", StdinData: stdinData})
+			}
+
+			Expect(del()).To(Succeed())
+			Expect(filepath.Join(path, "notify")).NotTo(BeAnExistingFile())
+
+			event := <-events
+			Expect(event.Type).To(Equal(minuteman.EventDeregister))
+			Expect(event.Registration.Labels).To(Equal(registration.Labels))
+
+			By("Invoking DEL again with minuteman gone")
+			server.Close()
+			Expect(del()).To(Succeed())
+		})
+	})
+
+	Describe("Watching registrations", func() {
+		var (
+			path    string
+			watcher *minuteman.Watcher
+		)
+
+		register := func(containerID string) {
+			data, err := json.Marshal(&minuteman.Registration{
+				Version:     minuteman.RegistrationVersion,
+				ContainerID: containerID,
+				Netns:       "/var/run/netns/" + containerID,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(registry.New(path).Put(containerID, data)).To(Succeed())
+		}
+
+		expectEvent := func(eventType minuteman.WatchEventType, containerID string) {
+			var event minuteman.WatchEvent
+			Eventually(watcher.Events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(eventType))
+			Expect(event.Registration.ContainerID).To(Equal(containerID))
+			Expect(event.Registration.Netns).To(Equal("/var/run/netns/" + containerID))
+		}
+
+		BeforeEach(func() {
+			var err error
+			path, err = ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+
+			register("existing")
+
+			watcher, err = minuteman.Watch(path)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(watcher.Close()).To(Succeed())
+			Expect(os.RemoveAll(path)).To(Succeed())
+			Expect(os.RemoveAll(path + ".state")).To(Succeed())
+		})
+
+		It("Lists the existing registrations first", func() {
+			expectEvent(minuteman.Added, "existing")
+			Consistently(watcher.Events).ShouldNot(Receive())
+		})
+
+		It("Follows registrations as they come and go", func() {
+			expectEvent(minuteman.Added, "existing")
+
+			register("new")
+			expectEvent(minuteman.Added, "new")
+
+			Expect(ioutil.WriteFile(filepath.Join(path, "legacy"), []byte("/var/run/netns/legacy"), 0644)).To(Succeed())
+			expectEvent(minuteman.Added, "legacy")
+
+			_, err := registry.New(path).Delete("existing")
+			Expect(err).NotTo(HaveOccurred())
+			expectEvent(minuteman.Removed, "existing")
+
+			Expect(os.Remove(filepath.Join(path, "legacy"))).To(Succeed())
+			expectEvent(minuteman.Removed, "legacy")
+		})
+
+		It("Reports registration records it can't read", func() {
+			expectEvent(minuteman.Added, "existing")
+
+			Expect(ioutil.WriteFile(filepath.Join(path, "broken"), []byte(`{"version": 1,`), 0644)).To(Succeed())
+			Eventually(watcher.Errors).Should(Receive())
+		})
+
+		It("Closes its channels once closed", func() {
+			expectEvent(minuteman.Added, "existing")
+
+			Expect(watcher.Close()).To(Succeed())
+			Eventually(watcher.Events).Should(BeClosed())
+			Eventually(watcher.Errors).Should(BeClosed())
+		})
+	})
+
+	Describe("Loading VIPs", func() {
+		var path string
+
+		BeforeEach(func() {
+			var err error
+			path, err = ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(path)).To(Succeed())
+		})
+
+		It("Reads the configured VIPs and the VIP file", func() {
+			vipFile := filepath.Join(path, "vips")
+			Expect(ioutil.WriteFile(vipFile, []byte("# Marathon VIPs\n11.0.0.1\n\n  11.1.0.0/24\nfd01::1\n"), 0644)).To(Succeed())
+
+			conf := &minuteman.NetConf{}
+			Expect(json.Unmarshal([]byte(`{"vips": ["11.2.0.1/32"], "vipFile": "`+vipFile+`"}`), conf)).To(Succeed())
+
+			vips, err := conf.LoadVIPs()
+			Expect(err).NotTo(HaveOccurred())
+
+			var cidrs []string
+			for _, vip := range vips {
+				cidrs = append(cidrs, vip.String())
+			}
+			Expect(cidrs).To(Equal([]string{"11.2.0.1/32", "11.0.0.1/32", "11.1.0.0/24", "fd01::1/128"}))
+		})
+
+		It("Has no VIPs from a missing VIP file", func() {
+			conf := &minuteman.NetConf{VIPFile: filepath.Join(path, "missing")}
+
+			vips, err := conf.LoadVIPs()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vips).To(BeEmpty())
+		})
+
+		It("Rejects invalid VIPs", func() {
+			vipFile := filepath.Join(path, "vips")
+			Expect(ioutil.WriteFile(vipFile, []byte("11.0.0.1\nmarathon\n"), 0644)).To(Succeed())
+
+			conf := &minuteman.NetConf{VIPFile: vipFile}
+			_, err := conf.LoadVIPs()
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(cnierrors.ErrInvalidConfig))
+		})
+	})
+
+	Describe("Deregistering", func() {
+		It("Reports registrations it fails to remove", func() {
+			file, err := ioutil.TempFile("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(file.Close()).To(Succeed())
+			defer os.Remove(file.Name())
+
+			// A registration directory that is a file can't be written.
+			stdinData, err := json.Marshal(&minuteman.NetConf{Enable: true, Path: file.Name()})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = minuteman.CniDel(&skel.CmdArgs{ContainerID: "container", StdinData: stdinData})
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(cnierrors.ErrIOFailure))
+		})
+	})
+
+	Describe("Status", func() {
+		It("Succeeds when the registration directory is writable", func() {
+			path, err := ioutil.TempDir("", "minuteman")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(path)
+
+			stdinData, err := json.Marshal(&minuteman.NetConf{Enable: true, Path: path + "/l4lb"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(minuteman.CniStatus(&skel.CmdArgs{StdinData: stdinData})).To(Succeed())
+			Expect(path + "/l4lb").To(BeADirectory())
+		})
+
+		It("Reports a registration directory that can't be created", func() {
+			stdinData, err := json.Marshal(&minuteman.NetConf{Enable: true, Path: "/dev/null/minuteman"})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = minuteman.CniStatus(&skel.CmdArgs{StdinData: stdinData})
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(cnierrors.ErrPluginNotAvailable))
+		})
+	})
+})
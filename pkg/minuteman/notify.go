@@ -0,0 +1,176 @@
+package minuteman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Types of the events that minuteman is notified of.
+const (
+	EventRegister   = "register"
+	EventDeregister = "deregister"
+)
+
+const (
+	// DefaultNotifyURL is the URL events are POSTed to when only a socket
+	// is configured.
+	DefaultNotifyURL = "http://localhost/v1/containers"
+	// DefaultNotifyTimeout bounds each attempt at notifying minuteman.
+	DefaultNotifyTimeout = time.Second
+	// DefaultNotifyBackoff is the wait before the first retry.
+	DefaultNotifyBackoff = 100 * time.Millisecond
+	// MaxNotifyBackoff bounds the wait between retries.
+	MaxNotifyBackoff = time.Second
+	// DefaultNotifyDeadline bounds the time spent notifying minuteman of
+	// an event, retries included. ADD and DEL wait for it, and the
+	// runtime won't wait for them forever.
+	DefaultNotifyDeadline = 3 * time.Second
+)
+
+// Event is what minuteman is notified of when a container is registered
+// or de-registered.
+type Event struct {
+	Type         string        `json:"type"`
+	Registration *Registration `json:"registration"`
+}
+
+// Enabled returns true if minuteman is to be notified of registrations.
+func (conf *NotifyConf) Enabled() bool {
+	return conf.URL != "" || conf.Socket != ""
+}
+
+// url returns the URL that events are POSTed to.
+func (conf *NotifyConf) url() string {
+	if conf.URL == "" {
+		return DefaultNotifyURL
+	}
+
+	return conf.URL
+}
+
+// Validate checks that the notification endpoint can be used.
+func (conf *NotifyConf) Validate() error {
+	if !conf.Enabled() {
+		return nil
+	}
+
+	u, err := url.Parse(conf.url())
+	if err != nil {
+		return fmt.Errorf("invalid minuteman notification URL %q: %s", conf.URL, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("minuteman notification URL %q is not an HTTP URL", conf.URL)
+	}
+
+	if conf.Timeout < 0 || conf.Retries < 0 || conf.Backoff < 0 || conf.Deadline < 0 {
+		return fmt.Errorf("invalid minuteman notification timeout %d, retries %d, backoff %d or deadline %d", conf.Timeout, conf.Retries, conf.Backoff, conf.Deadline)
+	}
+
+	return nil
+}
+
+// client returns the HTTP client sending the events.
+func (conf *NotifyConf) client() *http.Client {
+	timeout := DefaultNotifyTimeout
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Millisecond
+	}
+
+	transport := &http.Transport{DisableKeepAlives: true}
+	if conf.Socket != "" {
+		socket := conf.Socket
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// post makes a single attempt at sending `body`, which gives up once `ctx`
+// is done, and reports whether a failed attempt is worth retrying.
+func (conf *NotifyConf) post(ctx context.Context, client *http.Client, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, conf.url(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so that minuteman doesn't see the connection reset
+	// while still answering.
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	// Minuteman won't like the event any better the next time around.
+	return false, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// Notify POSTs `event` to the notification endpoint, retrying failed
+// attempts as configured until the deadline. Minuteman still learns about
+// the container from its registration record when this fails, only later.
+func (conf *NotifyConf) Notify(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := DefaultNotifyBackoff
+	if conf.Backoff > 0 {
+		backoff = time.Duration(conf.Backoff) * time.Millisecond
+	}
+
+	deadline := DefaultNotifyDeadline
+	if conf.Deadline > 0 {
+		deadline = time.Duration(conf.Deadline) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	client := conf.client()
+	for attempt := 0; ; attempt++ {
+		retry, err := conf.post(ctx, client, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= conf.Retries {
+			return fmt.Errorf("failed to notify minuteman at %s after %d attempts: %s", conf.url(), attempt+1, err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("failed to notify minuteman at %s within %s after %d attempts: %s", conf.url(), deadline, attempt+1, err)
+		}
+
+		backoff *= 2
+		if backoff > MaxNotifyBackoff {
+			backoff = MaxNotifyBackoff
+		}
+	}
+}
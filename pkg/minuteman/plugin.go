@@ -3,97 +3,238 @@ package minuteman
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"time"
 
-	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+	"github.com/dcos/dcos-cni/pkg/registry"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const DefaultPath = "/var/run/dcos/cni/l4lb"
 const IfName = "minuteman"
 
-func setupInterface(netns string) error {
+func setupInterface(netns string, vips, previous []net.IPNet) error {
 	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
-		dummy := &netlink.Dummy{
-			LinkAttrs: netlink.LinkAttrs{
-				Name: IfName,
-			},
+		var dummy netlink.Link
+
+		// A previous ADD for this container might have already created
+		// the interface, in which case we reuse it. Anything else that
+		// goes by our name gets replaced.
+		iface, err := netlink.LinkByName(IfName)
+		if err == nil {
+			if _, ok := iface.(*netlink.Dummy); ok {
+				log.Println("Reusing existing minuteman interface ", IfName)
+				dummy = iface
+			} else {
+				log.Printf("Replacing %s link named %s with a dummy interface", iface.Type(), IfName)
+				if err = netlink.LinkDel(iface); err != nil {
+					return cnierrors.Link(err, fmt.Sprintf("failed to delete %s", IfName))
+				}
+			}
+		} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return cnierrors.Link(err, fmt.Sprintf("failed to lookup %s", IfName))
 		}
 
-		err := netlink.LinkAdd(dummy)
-		if err != nil {
-			return fmt.Errorf("failed to create dummy interface: %s", err)
+		if dummy == nil {
+			dummy = &netlink.Dummy{
+				LinkAttrs: netlink.LinkAttrs{
+					Name: IfName,
+				},
+			}
+
+			err = netlink.LinkAdd(dummy)
+			if err != nil {
+				return cnierrors.Link(err, "failed to create dummy interface")
+			}
 		}
 
 		// Bring up the interface
 		err = netlink.LinkSetUp(dummy)
 		if err != nil {
-			return fmt.Errorf("unable to bring the dummy interface up: %s", err)
+			return cnierrors.Link(err, "unable to bring the dummy interface up")
 		}
 
-		return nil
+		// Pick up the index of a freshly created interface.
+		dummy, err = netlink.LinkByName(IfName)
+		if err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to lookup %s", IfName))
+		}
+
+		return syncVIPs(dummy, vips, previous)
 	})
 
 	if err != nil {
-		return fmt.Errorf("unable to configure minuteman interface in netns(%s): %s", netns, err)
+		return cnierrors.Netns(err, fmt.Sprintf("unable to configure minuteman interface in netns(%s)", netns))
 	}
 
 	return nil
 }
 
-func tearDownInterface(netns string) error {
+// tearDownInterface removes the minuteman interface from the container,
+// and reports whether there was an interface to remove. A network
+// namespace or interface that is already gone is not an error, so that
+// DEL can be retried.
+func tearDownInterface(netns string) (bool, error) {
+	removed := false
 	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
 		iface, err := netlink.LinkByName(IfName)
 		if err != nil {
-			return fmt.Errorf("failed to lookup %s: %s", IfName, err)
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+
+			return cnierrors.Link(err, fmt.Sprintf("failed to lookup %s", IfName))
 		}
 
 		if err = netlink.LinkDel(iface); err != nil {
-			return fmt.Errorf("failed to delete %s: %s", IfName, err)
+			return cnierrors.Link(err, fmt.Sprintf("failed to delete %s", IfName))
 		}
 
+		removed = true
 		return nil
 	})
 
+	// Once the network namespace is unmounted, its path is either gone
+	// or a plain file.
+	switch err.(type) {
+	case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		return false, nil
+	}
+
+	if err != nil {
+		return false, cnierrors.Netns(err, fmt.Sprintf("unable to remove minuteman interface in netns(%s)", netns))
+	}
+
+	return removed, nil
+}
+
+func checkInterface(netns string, vips []net.IPNet) error {
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		iface, err := netlink.LinkByName(IfName)
+		if err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to lookup %s", IfName))
+		}
+
+		if _, ok := iface.(*netlink.Dummy); !ok {
+			msg := fmt.Sprintf("%s is a %s link, expected a dummy link", IfName, iface.Type())
+			return cnierrors.New(cnierrors.ErrInterfaceConflict, msg, "")
+		}
+
+		return checkVIPs(iface, vips)
+	})
+
 	if err != nil {
-		return fmt.Errorf("unable to remove minuteman interface in netns(%s): %s", netns, err)
+		return cnierrors.Netns(err, fmt.Sprintf("minuteman interface missing in netns(%s)", netns))
 	}
 
 	return nil
 }
 
-func CniAdd(args *skel.CmdArgs) error {
+// CniAdd registers the container with minuteman, recording what
+// `registration` knows about the container besides its ID, interface and
+// network namespace, which are taken from `args`.
+func CniAdd(args *skel.CmdArgs, registration *Registration) error {
 	conf := &NetConf{}
 	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to load minuteman netconf: %s", err)
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load minuteman netconf")
 	}
 
 	if conf.Path == "" {
 		conf.Path = DefaultPath
 	}
 
-	// Create the directory where minuteman will search for the
-	// registered containers.
-	if err := os.MkdirAll(conf.Path, 0644); err != nil {
-		return fmt.Errorf("couldn't create directory for storing minuteman container registration information:%s", err)
+	switch conf.Format {
+	case "", FormatJSON, FormatLegacy:
+	default:
+		return cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("unknown minuteman registration format %q", conf.Format), "")
+	}
+
+	if err := conf.Notify.Validate(); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "invalid minuteman netconf")
+	}
+
+	vips, err := conf.LoadVIPs()
+	if err != nil {
+		return err
+	}
+
+	if registration == nil {
+		registration = &Registration{}
 	}
 
+	registration.Version = RegistrationVersion
+	registration.ContainerID = args.ContainerID
+	registration.Netns = args.Netns
+	registration.IfName = args.IfName
+	registration.Updated = time.Now().UTC()
+	registration.Created = registration.Updated
+
 	log.Println("Registering netns for containerID", args.ContainerID, " at path: ", conf.Path)
 
-	// Create a file with name `ContainerID` and write the network
-	// namespace into this file.
-	if err := ioutil.WriteFile(conf.Path+"/"+args.ContainerID, []byte(args.Netns), 0644); err != nil {
-		return fmt.Errorf("couldn't checkout point the network namespace for containerID:%s for minuteman", args.ContainerID)
+	// The VIPs assigned by a previous ADD for this container, which are
+	// to be removed unless they are still configured.
+	var previousVIPs []net.IPNet
+
+	// Create a record with name `ContainerID` in the directory where
+	// minuteman will search for the registered containers.
+	store := registry.New(conf.Path)
+	err = store.Update(args.ContainerID, func(previous []byte) ([]byte, error) {
+		registration.VIPs = nil
+		previousVIPs = nil
+
+		// ADD might be retried for the same container, which has been
+		// registered since the first attempt.
+		if previous, err := ParseRegistration(args.ContainerID, previous); err == nil {
+			if !previous.Created.IsZero() {
+				registration.Created = previous.Created
+			}
+
+			registration.VIPs = previous.VIPs
+			previousVIPs = toIPNets(previous.VIPs)
+		}
+
+		// Without VIPs configured, the VIPs of the minuteman interface
+		// are left to whatever else assigns them.
+		if conf.vipsConfigured() {
+			registration.VIPs = fromIPNets(vips)
+		} else {
+			previousVIPs = nil
+		}
+
+		return registration.marshal(conf.Format)
+	})
+
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("couldn't checkout point the network namespace for containerID:%s for minuteman", args.ContainerID))
 	}
 
 	log.Println("Creating minuteman interface ", IfName)
 	// Create a `minuteman` interface.
-	if err := setupInterface(args.Netns); err != nil {
-		return fmt.Errorf("failure in creating minuteman interface: %s", err)
+	if err := setupInterface(args.Netns, vips, previousVIPs); err != nil {
+		// Don't leave a registration behind for a container that
+		// minuteman can't serve.
+		if _, _err := store.Delete(args.ContainerID); _err != nil {
+			log.Printf("failed to remove registration for containerID:%s while rolling back: %s", args.ContainerID, _err)
+		}
+
+		return cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, "failure in creating minuteman interface")
+	}
+
+	// Minuteman would otherwise only learn about the container the next
+	// time it looks at the registration directory.
+	if conf.Notify.Enabled() {
+		if err := conf.Notify.Notify(&Event{Type: EventRegister, Registration: registration}); err != nil {
+			log.Printf("WARNING: %s", err)
+		}
 	}
 
 	return nil
@@ -102,24 +243,175 @@ func CniAdd(args *skel.CmdArgs) error {
 func CniDel(args *skel.CmdArgs) error {
 	conf := &NetConf{}
 	if err := json.Unmarshal(args.StdinData, conf); err != nil {
-		return fmt.Errorf("failed to load minuteman netconf: %s", err)
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load minuteman netconf")
 	}
 
-	// For failures just log to `stderr` instead of  failing with an
-	// error.
 	if conf.Path == "" {
 		conf.Path = DefaultPath
 	}
 
+	if err := conf.Notify.Validate(); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "invalid minuteman netconf")
+	}
+
+	// Tell minuteman as much as we know about the container it is
+	// losing.
+	deregistered := &Registration{
+		Version:     RegistrationVersion,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+	}
+	if conf.Notify.Enabled() {
+		if registration, err := ReadRegistration(conf.Path, args.ContainerID); err == nil {
+			deregistered = registration
+		}
+	}
+
 	// Remove the container registration.
-	if err := os.Remove(conf.Path + "/" + args.ContainerID); err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to remove registration for contianerID:%s from minuteman", args.ContainerID)
+	removed, err := registry.New(conf.Path).Delete(args.ContainerID)
+	switch {
+	case err != nil:
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("unable to remove registration for containerID:%s from minuteman", args.ContainerID))
+	case removed:
+		log.Println("Removed minuteman registration for containerID", args.ContainerID)
+	default:
+		log.Println("No minuteman registration left for containerID", args.ContainerID)
+	}
+
+	if conf.Notify.Enabled() {
+		if err := conf.Notify.Notify(&Event{Type: EventDeregister, Registration: deregistered}); err != nil {
+			log.Printf("WARNING: %s", err)
+		}
 	}
 
 	log.Println("Removing minuteman interface ", IfName)
 	// Deleate the `minuteman` interface.
-	if err := tearDownInterface(args.Netns); err != nil {
-		return fmt.Errorf("failure in deleting the minuteman interface: %s", err)
+	removed, err = tearDownInterface(args.Netns)
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, "failure in deleting the minuteman interface")
+	}
+
+	if removed {
+		log.Println("Removed minuteman interface ", IfName)
+	} else {
+		log.Println("No minuteman interface left in netns", args.Netns)
+	}
+
+	return nil
+}
+
+func CniCheck(args *skel.CmdArgs) error {
+	conf := &NetConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load minuteman netconf")
+	}
+
+	if conf.Path == "" {
+		conf.Path = DefaultPath
+	}
+
+	// The registration should still point minuteman at the container's
+	// network namespace.
+	registration, err := ReadRegistration(conf.Path, args.ContainerID)
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("registration for containerID:%s missing from %s", args.ContainerID, conf.Path))
+	}
+
+	if registration.Netns != args.Netns {
+		msg := fmt.Sprintf("registration for containerID:%s points at netns(%s), expected netns(%s)", args.ContainerID, registration.Netns, args.Netns)
+		return cnierrors.New(cnierrors.ErrIOFailure, msg, "")
+	}
+
+	vips, err := conf.LoadVIPs()
+	if err != nil {
+		return err
+	}
+
+	if err := checkInterface(args.Netns, vips); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, "failure in checking minuteman interface")
+	}
+
+	return nil
+}
+
+// CniGC removes the registrations of containers on the dcos-l4lb
+// `network` that are not part of `attachments`, which were left behind by
+// containers that went away without a DEL. The registration directory is
+// shared by every network on the host, so registrations of other networks
+// are left alone. Legacy records don't name their network, and are taken
+// to belong to `network` if it writes legacy records, which then needs a
+// registration directory of its own.
+func CniGC(args *skel.CmdArgs, network string, attachments []types.GCAttachment) error {
+	conf := &NetConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load minuteman netconf")
+	}
+
+	if conf.Path == "" {
+		conf.Path = DefaultPath
+	}
+
+	containerIDs := map[string]bool{}
+	for _, attachment := range attachments {
+		containerIDs[attachment.ContainerID] = true
+	}
+
+	store := registry.New(conf.Path)
+	registered, err := store.List()
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("couldn't list minuteman registrations in %s", conf.Path))
+	}
+
+	for _, containerID := range registered {
+		if containerIDs[containerID] {
+			continue
+		}
+
+		registration, err := ReadRegistration(conf.Path, containerID)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Skipping unreadable minuteman registration for containerID:%s: %s", containerID, err)
+			continue
+		}
+
+		if registration.Network != network && !(registration.Network == "" && conf.Format == FormatLegacy) {
+			continue
+		}
+
+		removed, err := store.Delete(containerID)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("couldn't remove stale registration for containerID:%s", containerID))
+		}
+
+		if removed {
+			log.Println("Removed stale minuteman registration for containerID", containerID)
+		}
+	}
+
+	return nil
+}
+
+// CniStatus checks that containers can be registered with minuteman.
+func CniStatus(args *skel.CmdArgs) error {
+	conf := &NetConf{}
+	if err := json.Unmarshal(args.StdinData, conf); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to load minuteman netconf")
+	}
+
+	if conf.Path == "" {
+		conf.Path = DefaultPath
+	}
+
+	if err := registry.New(conf.Path).Create(); err != nil {
+		return cnierrors.New(cnierrors.ErrPluginNotAvailable, fmt.Sprintf("couldn't create minuteman registration directory %s", conf.Path), err.Error())
+	}
+
+	if err := unix.Access(conf.Path, unix.W_OK); err != nil {
+		return cnierrors.New(cnierrors.ErrPluginNotAvailable, fmt.Sprintf("minuteman registration directory %s is not writable", conf.Path), err.Error())
 	}
 
 	return nil
@@ -0,0 +1,143 @@
+package minuteman
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/dcos/dcos-cni/pkg/registry"
+)
+
+// RegistrationVersion is the version of the registration records written
+// by `CniAdd`. Legacy records, which hold nothing but the path of the
+// container's network namespace, have version 0.
+const RegistrationVersion = 1
+
+// Formats of the registration records written by `CniAdd`.
+const (
+	FormatJSON   = "json"
+	FormatLegacy = "legacy"
+)
+
+// Registration is what minuteman knows about a container registered with
+// it.
+type Registration struct {
+	Version     int    `json:"version"`
+	ContainerID string `json:"containerId"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifName,omitempty"`
+	// The CNI network the container is attached to.
+	Network string `json:"network,omitempty"`
+	// The IPs assigned to the container by the delegate plugin, or the
+	// previous plugin in the chain.
+	ContainerIPs []net.IP `json:"containerIPs,omitempty"`
+	// The IPs assigned to the container on the spartan network.
+	SpartanIPs []net.IP `json:"spartanIPs,omitempty"`
+	// The VIPs that the plugin assigned to the minuteman interface, and
+	// removes once they are no longer configured.
+	VIPs []types.IPNet `json:"vips,omitempty"`
+	// The labels of the Mesos network the container is attached to.
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+// ParseRegistration parses the registration record of the container
+// `containerID`, in either format.
+func ParseRegistration(containerID string, data []byte) (*Registration, error) {
+	data = bytes.TrimSpace(data)
+
+	if !bytes.HasPrefix(data, []byte("{")) {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("empty registration for containerID:%s", containerID)
+		}
+
+		return &Registration{ContainerID: containerID, Netns: string(data)}, nil
+	}
+
+	registration := &Registration{}
+	if err := json.Unmarshal(data, registration); err != nil {
+		return nil, fmt.Errorf("invalid registration for containerID:%s: %s", containerID, err)
+	}
+
+	if registration.Version < 1 || registration.Version > RegistrationVersion {
+		return nil, fmt.Errorf("unsupported version %d of the registration for containerID:%s", registration.Version, containerID)
+	}
+
+	if registration.ContainerID != containerID {
+		return nil, fmt.Errorf("registration for containerID:%s belongs to containerID:%s", containerID, registration.ContainerID)
+	}
+
+	if registration.Netns == "" {
+		return nil, fmt.Errorf("registration for containerID:%s has no netns", containerID)
+	}
+
+	return registration, nil
+}
+
+// ReadRegistration reads the registration record of the container
+// `containerID` from the directory `path`. Legacy records don't carry
+// timestamps, so they get the modification time of the record instead.
+func ReadRegistration(path, containerID string) (*Registration, error) {
+	record, err := registry.New(path).Get(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	registration, err := ParseRegistration(containerID, record.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if registration.Version == 0 {
+		registration.Created = record.ModTime.UTC()
+		registration.Updated = registration.Created
+	}
+
+	return registration, nil
+}
+
+// ReadRegistrations reads the registration records of all containers
+// registered in the directory `path`. A missing directory has no records.
+func ReadRegistrations(path string) ([]*Registration, error) {
+	containerIDs, err := registry.New(path).List()
+	if err != nil {
+		return nil, err
+	}
+
+	var registrations []*Registration
+	for _, containerID := range containerIDs {
+		registration, err := ReadRegistration(path, containerID)
+
+		// The container might have been de-registered since we listed
+		// the directory.
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		registrations = append(registrations, registration)
+	}
+
+	return registrations, nil
+}
+
+// marshal returns the registration record in `format`.
+func (registration *Registration) marshal(format string) ([]byte, error) {
+	switch format {
+	case "", FormatJSON:
+		return json.Marshal(registration)
+	case FormatLegacy:
+		return []byte(registration.Netns), nil
+	}
+
+	return nil, fmt.Errorf("unknown registration format %q", format)
+}
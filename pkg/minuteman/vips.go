@@ -0,0 +1,340 @@
+package minuteman
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+	"github.com/dcos/dcos-cni/pkg/registry"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// parseVIP parses a VIP CIDR, or a single address.
+func parseVIP(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	ip, vip, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+
+	vip.IP = ip
+	return vip, nil
+}
+
+// readVIPFile reads the VIPs listed in `path`, one per line. Blank lines
+// and lines starting with `#` are skipped. A missing file lists no VIPs,
+// since whatever maintains it might not have written it yet.
+func readVIPFile(path string) ([]net.IPNet, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("No VIP file at %s", path)
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var vips []net.IPNet
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		vip, err := parseVIP(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VIP %q on line %d of %s", text, line, path)
+		}
+
+		vips = append(vips, *vip)
+	}
+
+	return vips, scanner.Err()
+}
+
+// vipsConfigured returns true if VIPs are to be assigned to the minuteman
+// interface. Otherwise the interface is left to whatever else assigns
+// VIPs to it.
+func (conf *NetConf) vipsConfigured() bool {
+	return len(conf.VIPs) > 0 || conf.VIPFile != ""
+}
+
+// LoadVIPs returns the VIPs to assign to the minuteman interface, those
+// listed in `VIPs` followed by those in `VIPFile`.
+func (conf *NetConf) LoadVIPs() ([]net.IPNet, error) {
+	var vips []net.IPNet
+	for _, vip := range conf.VIPs {
+		if vip.IP == nil || vip.Mask == nil {
+			return nil, cnierrors.New(cnierrors.ErrInvalidConfig, "minuteman VIPs must be CIDRs", "")
+		}
+
+		vips = append(vips, net.IPNet(vip))
+	}
+
+	if conf.VIPFile != "" {
+		fileVIPs, err := readVIPFile(conf.VIPFile)
+		if err != nil {
+			return nil, cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, fmt.Sprintf("failed to read the minuteman VIPs from %s", conf.VIPFile))
+		}
+
+		vips = append(vips, fileVIPs...)
+	}
+
+	return vips, nil
+}
+
+// fromIPNets converts `vips` to their form in registration records.
+func fromIPNets(vips []net.IPNet) []types.IPNet {
+	var ipNets []types.IPNet
+	for _, vip := range vips {
+		ipNets = append(ipNets, types.IPNet(vip))
+	}
+
+	return ipNets
+}
+
+// toIPNets converts `vips` from their form in registration records.
+func toIPNets(vips []types.IPNet) []net.IPNet {
+	var ipNets []net.IPNet
+	for _, vip := range vips {
+		ipNets = append(ipNets, net.IPNet(vip))
+	}
+
+	return ipNets
+}
+
+// localRoute returns the route making the container accept traffic to
+// every address of `vip`, and not just the address assigned to the
+// minuteman interface.
+func localRoute(link netlink.Link, vip net.IPNet) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &net.IPNet{IP: vip.IP.Mask(vip.Mask), Mask: vip.Mask},
+		Table:     unix.RT_TABLE_LOCAL,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+	}
+}
+
+// syncVIPs assigns `vips` to the minuteman interface `link`, along with
+// their local routes, and removes the VIPs of `previous`, those assigned
+// the last time around, that are no longer listed. Addresses assigned by
+// anyone else are left alone. It has to be called from within the
+// container's network namespace.
+func syncVIPs(link netlink.Link, vips, previous []net.IPNet) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return cnierrors.Link(err, fmt.Sprintf("failed to list addresses on %s", IfName))
+	}
+
+	assigned := map[string]bool{}
+	for _, addr := range addrs {
+		assigned[addr.IPNet.String()] = true
+	}
+
+	wanted := map[string]bool{}
+	for _, vip := range vips {
+		wanted[vip.String()] = true
+	}
+
+	for _, vip := range previous {
+		vip := vip
+		if wanted[vip.String()] {
+			continue
+		}
+
+		// Removing an address takes its own local route along, but not
+		// the route we added for the rest of its VIP range.
+		if ones, bits := vip.Mask.Size(); ones != bits {
+			if err := netlink.RouteDel(localRoute(link, vip)); err != nil && err != unix.ESRCH {
+				return cnierrors.Link(err, fmt.Sprintf("failed to remove local route for VIP %s", vip.String()))
+			}
+		}
+
+		if !assigned[vip.String()] {
+			continue
+		}
+
+		if err := netlink.AddrDel(link, &netlink.Addr{IPNet: &vip}); err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to remove VIP %s from %s", vip.String(), IfName))
+		}
+
+		log.Printf("Removed VIP %s from %s", vip.String(), IfName)
+	}
+
+	for _, vip := range vips {
+		vip := vip
+		if !assigned[vip.String()] {
+			// Nothing else can be using the VIPs in the container, so
+			// skip IPv6 duplicate address detection.
+			addr := &netlink.Addr{IPNet: &vip}
+			if vip.IP.To4() == nil {
+				addr.Flags = unix.IFA_F_NODAD
+			}
+
+			if err := netlink.AddrAdd(link, addr); err != nil && !os.IsExist(err) {
+				return cnierrors.Link(err, fmt.Sprintf("failed to add VIP %s to %s", vip.String(), IfName))
+			}
+
+			log.Printf("Added VIP %s to %s", vip.String(), IfName)
+		}
+
+		// The kernel adds the local route of a single address itself.
+		if ones, bits := vip.Mask.Size(); ones == bits {
+			continue
+		}
+
+		if err := netlink.RouteReplace(localRoute(link, vip)); err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to add local route for VIP %s", vip.String()))
+		}
+	}
+
+	return nil
+}
+
+// checkVIPs checks that `vips` are assigned to the minuteman interface
+// `link`. It has to be called from within the container's network
+// namespace.
+func checkVIPs(link netlink.Link, vips []net.IPNet) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return cnierrors.Link(err, fmt.Sprintf("failed to list addresses on %s", IfName))
+	}
+
+	for _, vip := range vips {
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == vip.String() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return cnierrors.New(cnierrors.ErrInterfaceFailure, fmt.Sprintf("VIP %s is missing from %s", vip.String(), IfName), "")
+		}
+	}
+
+	return nil
+}
+
+// recordVIPs records `vips` as the VIPs assigned to the minuteman interface
+// of the container `containerID`, registered in `path`, unless its
+// registration record is a legacy record, which has no room for them.
+func recordVIPs(path, containerID string, vips []net.IPNet) error {
+	return registry.New(path).Update(containerID, func(previous []byte) ([]byte, error) {
+		// The container might have been de-registered in the meantime.
+		if len(previous) == 0 {
+			return nil, os.ErrNotExist
+		}
+
+		registration, err := ParseRegistration(containerID, previous)
+		if err != nil {
+			return nil, err
+		}
+
+		if registration.Version == 0 {
+			return previous, nil
+		}
+
+		registration.VIPs = fromIPNets(vips)
+		return json.Marshal(registration)
+	})
+}
+
+// Reconcile assigns the VIPs currently configured to the minuteman
+// interface of every container registered on the dcos-l4lb `network`, and
+// removes the VIPs that it assigned earlier but are no longer configured,
+// so that running containers follow changes to the VIPs. The registration
+// directory is shared by every network on the host, so containers of other
+// networks, and legacy records that don't name their network, are left
+// alone. Containers that went away in the meantime are skipped, and every
+// other container is reconciled even if some fail, the first failure being
+// returned. Without VIPs configured, the VIPs assigned earlier are removed,
+// and the minuteman interfaces that have none are left alone.
+func Reconcile(conf *NetConf, network string) error {
+	path := conf.Path
+	if path == "" {
+		path = DefaultPath
+	}
+
+	vips, err := conf.LoadVIPs()
+	if err != nil {
+		return err
+	}
+
+	registrations, err := ReadRegistrations(path)
+	if err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("couldn't list minuteman registrations in %s", path))
+	}
+
+	var firstErr error
+	for _, registration := range registrations {
+		if registration.Network != network {
+			continue
+		}
+
+		if !conf.vipsConfigured() && len(registration.VIPs) == 0 {
+			continue
+		}
+
+		err := ns.WithNetNSPath(registration.Netns, func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(IfName)
+			if err != nil {
+				return cnierrors.Link(err, fmt.Sprintf("failed to lookup %s", IfName))
+			}
+
+			return syncVIPs(link, vips, toIPNets(registration.VIPs))
+		})
+
+		// Once the network namespace is unmounted, its path is either
+		// gone or a plain file.
+		switch err.(type) {
+		case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+			log.Println("Skipping VIPs of containerID", registration.ContainerID, ", its netns is gone")
+			continue
+		}
+
+		if err != nil {
+			log.Printf("failed to reconcile VIPs of containerID:%s: %s", registration.ContainerID, err)
+			if firstErr == nil {
+				firstErr = cnierrors.Netns(err, fmt.Sprintf("unable to reconcile VIPs in netns(%s)", registration.Netns))
+			}
+			continue
+		}
+
+		// Remember which VIPs to remove should they no longer be
+		// configured the next time around.
+		err = recordVIPs(path, registration.ContainerID, vips)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to record VIPs of containerID:%s: %s", registration.ContainerID, err)
+			if firstErr == nil {
+				firstErr = cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("couldn't record the VIPs of containerID:%s", registration.ContainerID))
+			}
+		}
+	}
+
+	return firstErr
+}
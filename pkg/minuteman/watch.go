@@ -0,0 +1,248 @@
+package minuteman
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/dcos/dcos-cni/pkg/registry"
+
+	"golang.org/x/sys/unix"
+)
+
+// WatchEventType tells whether a container was registered or
+// de-registered.
+type WatchEventType string
+
+const (
+	// Added is sent when a container is registered, and again whenever
+	// its registration record is replaced, such as by a retried ADD.
+	Added WatchEventType = "added"
+	// Removed is sent when a container is de-registered.
+	Removed WatchEventType = "removed"
+)
+
+// WatchEvent is a change to the registrations. The registration of a
+// removed container is the last one seen before it went away.
+type WatchEvent struct {
+	Type         WatchEventType
+	Registration *Registration
+}
+
+// Watcher follows the registrations in a directory.
+type Watcher struct {
+	// Events delivers the changes to the registrations. It is closed
+	// once the watcher stops.
+	Events <-chan WatchEvent
+	// Errors delivers the problems the watcher runs into, such as
+	// registration records it can't read. It is closed once the watcher
+	// stops.
+	Errors <-chan error
+
+	path      string
+	inotify   *os.File
+	events    chan WatchEvent
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// The registrations sent as `Added`, by container ID.
+	known map[string]*Registration
+}
+
+// watchMask selects the inotify events that change the registrations.
+// Records are normally renamed into place, but legacy writers write them
+// in place.
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+
+// Watch follows the registrations in the directory `path`, creating it if
+// needed. Every registration already in the directory is sent as `Added`
+// first, followed by the changes as they happen. If the kernel drops
+// changes, the watcher lists the directory again and sends whatever
+// changed in the meantime.
+func Watch(path string) (*Watcher, error) {
+	if err := registry.New(path).Create(); err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %s", err)
+	}
+
+	// Watch before the initial listing, so that no change falls in
+	// between.
+	if _, err := unix.InotifyAddWatch(fd, path, watchMask); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %s", path, err)
+	}
+
+	events := make(chan WatchEvent)
+	errors := make(chan error)
+	w := &Watcher{
+		Events:  events,
+		Errors:  errors,
+		path:    path,
+		inotify: os.NewFile(uintptr(fd), "inotify"),
+		events:  events,
+		errors:  errors,
+		done:    make(chan struct{}),
+		known:   map[string]*Registration{},
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Close stops the watcher, and waits for it to close its channels.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.inotify.Close()
+	})
+
+	w.wg.Wait()
+	return err
+}
+
+// sendEvent sends `event`, and reports whether the watcher should keep
+// going.
+func (w *Watcher) sendEvent(event WatchEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendError sends `err`, and reports whether the watcher should keep
+// going.
+func (w *Watcher) sendError(err error) bool {
+	select {
+	case w.errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// added sends the registration of the container `containerID` as
+// `Added`, unless it hasn't changed since it was last sent.
+func (w *Watcher) added(containerID string) bool {
+	registration, err := ReadRegistration(w.path, containerID)
+	if os.IsNotExist(err) {
+		return w.removed(containerID)
+	}
+
+	if err != nil {
+		return w.sendError(err)
+	}
+
+	if reflect.DeepEqual(w.known[containerID], registration) {
+		return true
+	}
+
+	w.known[containerID] = registration
+	return w.sendEvent(WatchEvent{Type: Added, Registration: registration})
+}
+
+// removed sends the registration of the container `containerID` as
+// `Removed`, unless it was never sent as `Added`.
+func (w *Watcher) removed(containerID string) bool {
+	registration, ok := w.known[containerID]
+	if !ok {
+		return true
+	}
+
+	delete(w.known, containerID)
+	return w.sendEvent(WatchEvent{Type: Removed, Registration: registration})
+}
+
+// resync lists the registrations, and sends whatever changed since they
+// were last sent.
+func (w *Watcher) resync() bool {
+	containerIDs, err := registry.New(w.path).List()
+	if err != nil {
+		return w.sendError(err)
+	}
+
+	registered := map[string]bool{}
+	for _, containerID := range containerIDs {
+		registered[containerID] = true
+		if !w.added(containerID) {
+			return false
+		}
+	}
+
+	for containerID := range w.known {
+		if !registered[containerID] && !w.removed(containerID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handle acts on a single inotify event, and reports whether the watcher
+// should keep going.
+func (w *Watcher) handle(mask uint32, name string) bool {
+	switch {
+	case mask&unix.IN_Q_OVERFLOW != 0:
+		return w.resync()
+	case mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0:
+		w.sendError(fmt.Errorf("registration directory %s went away", w.path))
+		return false
+	case !registry.IsRecord(name):
+		// Not a registration record.
+		return true
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		return w.removed(name)
+	case mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+		return w.added(name)
+	}
+
+	return true
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+	defer close(w.errors)
+	defer close(w.events)
+
+	if !w.resync() {
+		return
+	}
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.sendError(fmt.Errorf("failed to read inotify events: %s", err))
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+
+			name := string(bytes.TrimRight(buf[nameStart:offset], "\x00"))
+			if !w.handle(event.Mask, name) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Package registry keeps one record per container in a directory, such as
+// the registrations of containers with minuteman. Records are replaced
+// atomically, so that readers never see a partially written record, even
+// if the writer crashes, and writers of the same record are serialized
+// with a lock per container.
+//
+// The registry directory holds nothing but the records, since its readers
+// take every file in it for a record. The lock files and the records being
+// written live in the state directory, `<dir>.state`, next to it. Records
+// are renamed from there into place, so both have to be on the same file
+// system.
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DirMode is the mode of the registry directory, which has to be
+	// traversable by the readers of the records.
+	DirMode os.FileMode = 0755
+	// FileMode is the mode of the records.
+	FileMode os.FileMode = 0644
+)
+
+// stateSuffix is appended to the registry directory to name the state
+// directory.
+const stateSuffix = ".state"
+
+// Registry is a directory of records, one per container.
+type Registry struct {
+	dir      string
+	stateDir string
+}
+
+// Record is the record of a container.
+type Record struct {
+	ID      string
+	Data    []byte
+	ModTime time.Time
+}
+
+// New returns the registry kept in `dir`, which is created on the first
+// write.
+func New(dir string) *Registry {
+	return &Registry{dir: dir, stateDir: filepath.Clean(dir) + stateSuffix}
+}
+
+// Dir returns the directory of the registry.
+func (r *Registry) Dir() string {
+	return r.dir
+}
+
+// validateID checks that `id` can be used as the name of a record.
+func validateID(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsRune(id, filepath.Separator) {
+		return fmt.Errorf("invalid container ID %q", id)
+	}
+
+	return nil
+}
+
+// IsRecord reports whether `name`, an entry of the registry directory, can
+// be the record of a container.
+func IsRecord(name string) bool {
+	return validateID(name) == nil
+}
+
+// Create creates the registry and state directories, unless they already
+// exist. It also fixes up the mode of registry directories created by
+// earlier versions, which could not be traversed.
+func (r *Registry) Create() error {
+	info, err := os.Stat(r.dir)
+	if err == nil && info.Mode().Perm()&0111 == 0 {
+		if err := os.Chmod(r.dir, info.Mode().Perm()|0111); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(r.dir, DirMode); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(r.stateDir, DirMode)
+}
+
+// lock takes the lock of the record `id`, which is released by closing
+// the returned file.
+func (r *Registry) lock(id string) (*os.File, error) {
+	path := filepath.Join(r.stateDir, id+".lock")
+
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, FileMode)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %s", path, err)
+		}
+
+		// `Delete` removes the lock file while holding the lock, in
+		// which case we hold a lock nobody else will ever wait for, and
+		// have to start over.
+		held, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(held, current) {
+			return file, nil
+		}
+
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// syncDir flushes the entries of the registry directory to disk.
+func (r *Registry) syncDir() error {
+	dir, err := os.Open(r.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// tempPath returns the path to which the record `id` is written before
+// being renamed into place. Only the holder of the lock of the record
+// writes to it, and a file left behind by a crash is overwritten by the
+// next write.
+func (r *Registry) tempPath(id string) string {
+	return filepath.Join(r.stateDir, id+".tmp")
+}
+
+// write atomically replaces the record `id` with `data`.
+func (r *Registry) write(id string, data []byte) error {
+	tempPath := r.tempPath(id)
+
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if _err := file.Close(); err == nil {
+		err = _err
+	}
+
+	if err == nil {
+		err = os.Rename(tempPath, filepath.Join(r.dir, id))
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return r.syncDir()
+}
+
+// Update replaces the record `id` with what `update` returns, given the
+// current record, or nil if there is none. Nobody else can update or
+// delete the record in the meantime.
+func (r *Registry) Update(id string, update func(previous []byte) ([]byte, error)) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+
+	if err := r.Create(); err != nil {
+		return err
+	}
+
+	lock, err := r.lock(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	previous, err := ioutil.ReadFile(filepath.Join(r.dir, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := update(previous)
+	if err != nil {
+		return err
+	}
+
+	return r.write(id, data)
+}
+
+// Put replaces the record `id` with `data`.
+func (r *Registry) Put(id string, data []byte) error {
+	return r.Update(id, func([]byte) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// Get returns the record `id`. A missing record is reported with an error
+// satisfying `os.IsNotExist`.
+func (r *Registry) Get(id string) (*Record, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+
+	// Records are replaced by renaming, so whatever we open is complete.
+	file, err := os.Open(filepath.Join(r.dir, id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Record{ID: id, Data: data, ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the record `id`, and reports whether there was a record
+// to remove.
+func (r *Registry) Delete(id string) (bool, error) {
+	if err := validateID(id); err != nil {
+		return false, err
+	}
+
+	// Without a registry directory there is nothing to delete.
+	if _, err := os.Stat(r.dir); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err := r.Create(); err != nil {
+		return false, err
+	}
+
+	lock, err := r.lock(id)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+
+	removed := true
+	err = os.Remove(filepath.Join(r.dir, id))
+	if os.IsNotExist(err) {
+		removed = false
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := os.Remove(r.tempPath(id)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := r.syncDir(); err != nil {
+		return false, err
+	}
+
+	// Whoever is waiting for the lock notices that the lock file is gone
+	// once we release it.
+	if err := os.Remove(lock.Name()); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return removed, nil
+}
+
+// List returns the IDs of the containers that have a record. A missing
+// registry directory has no records.
+func (r *Registry) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(r.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && IsRecord(entry.Name()) {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,177 @@
+package registry_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/dcos/dcos-cni/pkg/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		parent string
+		dir    string
+		store  *registry.Registry
+	)
+
+	BeforeEach(func() {
+		var err error
+		parent, err = ioutil.TempDir("", "registry")
+		Expect(err).NotTo(HaveOccurred())
+
+		dir = filepath.Join(parent, "l4lb")
+		store = registry.New(dir)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(parent)).To(Succeed())
+	})
+
+	It("Stores records", func() {
+		Expect(store.Put("container", []byte("first"))).To(Succeed())
+		Expect(store.Put("container", []byte("second"))).To(Succeed())
+
+		record, err := store.Get("container")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(record.ID).To(Equal("container"))
+		Expect(string(record.Data)).To(Equal("second"))
+		Expect(record.ModTime).NotTo(BeZero())
+
+		info, err := os.Stat(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(registry.DirMode))
+
+		info, err = os.Stat(filepath.Join(dir, "container"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(registry.FileMode))
+	})
+
+	It("Reports missing records", func() {
+		_, err := store.Get("missing")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("Rejects invalid container IDs", func() {
+		for _, id := range []string{"", ".", "..", ".hidden", "../escape", "a/b"} {
+			Expect(store.Put(id, []byte("data"))).NotTo(Succeed(), "accepted %q", id)
+		}
+	})
+
+	It("Keeps nothing but records in the registry directory", func() {
+		Expect(store.Put("container", []byte("data"))).To(Succeed())
+		_, err := store.Delete("other")
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name()).To(Equal("container"))
+		Expect(dir + ".state").To(BeADirectory())
+	})
+
+	It("Hands the current record to updates", func() {
+		var previous [][]byte
+		for _, data := range []string{"first", "second"} {
+			data := data
+			err := store.Update("container", func(p []byte) ([]byte, error) {
+				previous = append(previous, p)
+				return []byte(data), nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(previous).To(Equal([][]byte{nil, []byte("first")}))
+	})
+
+	It("Serializes updates of the same record", func() {
+		Expect(store.Put("counter", []byte("0"))).To(Succeed())
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				err := store.Update("counter", func(previous []byte) ([]byte, error) {
+					n, err := strconv.Atoi(string(previous))
+					if err != nil {
+						return nil, err
+					}
+
+					return []byte(strconv.Itoa(n + 1)), nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}()
+		}
+		wg.Wait()
+
+		record, err := store.Get("counter")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record.Data)).To(Equal("20"))
+	})
+
+	It("Ignores what a crashed write left behind", func() {
+		Expect(store.Put("container", []byte("complete"))).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir+".state", "container.tmp"), []byte("trunc"), 0644)).To(Succeed())
+
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"container"}))
+
+		record, err := store.Get("container")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record.Data)).To(Equal("complete"))
+
+		Expect(store.Put("container", []byte("replaced"))).To(Succeed())
+		Expect(filepath.Join(dir+".state", "container.tmp")).NotTo(BeAnExistingFile())
+	})
+
+	It("Lists and deletes records", func() {
+		for _, id := range []string{"a", "b"} {
+			Expect(store.Put(id, []byte(id))).To(Succeed())
+		}
+
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(ConsistOf("a", "b"))
+
+		removed, err := store.Delete("a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(BeTrue())
+
+		removed, err = store.Delete("a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(BeFalse())
+
+		ids, err = store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{"b"}))
+	})
+
+	It("Has no records without a registry directory", func() {
+		ids, err := store.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(BeEmpty())
+
+		removed, err := store.Delete("container")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(BeFalse())
+		Expect(dir).NotTo(BeADirectory())
+	})
+
+	It("Makes directories created by earlier versions traversable", func() {
+		Expect(os.Mkdir(dir, 0644)).To(Succeed())
+		Expect(store.Create()).To(Succeed())
+
+		info, err := os.Stat(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+	})
+})
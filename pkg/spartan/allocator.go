@@ -0,0 +1,248 @@
+package spartan
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+)
+
+// lastReservedIPPrefix prefixes the files in which the host-local store
+// records the last address it allocated from each range set.
+const lastReservedIPPrefix = "last_reserved_ip."
+
+// leaseStore is the lease store of the host-local IPAM plugin, except
+// that leases are written to a temporary file and synced before being
+// linked into place. A crash can therefore never leave behind an empty or
+// truncated lease, which would hold its address without saying who for.
+type leaseStore struct {
+	*disk.Store
+	dir string
+}
+
+var _ backend.Store = &leaseStore{}
+
+// openLeaseStore opens the lease store of the spartan network, creating
+// it if needed.
+func (conf *NetConf) openLeaseStore() (*leaseStore, error) {
+	dataDir := conf.dataDir()
+
+	store, err := disk.New(NetworkName, dataDir)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to open the spartan lease store")
+	}
+
+	return &leaseStore{Store: store, dir: filepath.Join(dataDir, NetworkName)}, nil
+}
+
+// Reserve leases `addr` to the interface `ifname` of container `id`, and
+// returns false if the address is already leased.
+func (s *leaseStore) Reserve(id string, ifname string, addr net.IP, rangeID string) (bool, error) {
+	lease := disk.GetEscapedPath(s.dir, addr.String())
+	data := []byte(strings.TrimSpace(id) + disk.LineBreak + ifname)
+
+	// Linking fails if the lease exists, so that two allocators can't
+	// both believe they hold the address.
+	if err := s.writeFile(lease, data, os.Link); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	lastReservedIP := disk.GetEscapedPath(s.dir, lastReservedIPPrefix+rangeID)
+	if err := s.writeFile(lastReservedIP, []byte(addr.String()), os.Rename); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// writeFile writes `data` to a temporary file in the store and syncs it,
+// then moves it to `path` with `install`, and syncs the store directory.
+func (s *leaseStore) writeFile(path string, data []byte, install func(string, string) error) error {
+	// The name of the temporary file is not an address, so nobody
+	// mistakes it for a lease.
+	f, err := ioutil.TempFile(s.dir, ".lease-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := install(f.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// dataDir returns the directory in which the leases of the spartan
+// network are kept.
+func (conf *NetConf) dataDir() string {
+	if conf.IPAM.DataDir == "" {
+		return DefaultDataDir
+	}
+
+	return conf.IPAM.DataDir
+}
+
+// leasesAuthoritative reports whether the spartan lease store holds every
+// address leased on the spartan network, which it only does if it is kept
+// by the built-in allocator or the host-local IPAM plugin.
+func (conf *NetConf) leasesAuthoritative() bool {
+	return conf.IPAM.Type == BuiltinIPAM || conf.IPAM.Type == "host-local"
+}
+
+// allocatorRangeSets returns the range sets of the spartan network in the
+// form that the host-local allocator works with.
+func (conf *NetConf) allocatorRangeSets() ([]allocator.RangeSet, error) {
+	var rangeSets []allocator.RangeSet
+	for _, rangeSet := range conf.rangeSets() {
+		var rs allocator.RangeSet
+		for _, r := range rangeSet {
+			start, end := r.bounds()
+			rs = append(rs, allocator.Range{
+				Subnet:     r.Subnet,
+				RangeStart: start,
+				RangeEnd:   end,
+			})
+		}
+
+		if err := rs.Canonicalize(); err != nil {
+			return nil, cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "invalid range set in the spartan network")
+		}
+
+		rangeSets = append(rangeSets, rs)
+	}
+
+	return rangeSets, nil
+}
+
+// Allocate leases the container an address from each range set of the
+// spartan network, the way the host-local IPAM plugin would.
+func (conf *NetConf) Allocate(args *skel.CmdArgs) (*current.Result, error) {
+	rangeSets, err := conf.allocatorRangeSets()
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := conf.openLeaseStore()
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	for idx := range rangeSets {
+		ipConf, err := allocator.NewIPAllocator(&rangeSets[idx], store, idx).Get(args.ContainerID, args.IfName, nil)
+		if err != nil {
+			if _err := conf.Release(args); _err != nil {
+				log.Printf("failed to release spartan IPs after failing to allocate: %s", _err)
+			}
+			return nil, cnierrors.IPAM(err, fmt.Sprintf("failed to allocate for range %d", idx))
+		}
+
+		result.IPs = append(result.IPs, ipConf)
+	}
+
+	return result, nil
+}
+
+// Release removes the leases of the container.
+func (conf *NetConf) Release(args *skel.CmdArgs) error {
+	store, err := conf.openLeaseStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.Lock(); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to lock the spartan lease store")
+	}
+	defer store.Unlock()
+
+	if err := store.ReleaseByID(args.ContainerID, args.IfName); err != nil {
+		return cnierrors.IPAM(err, "failed to release spartan IPs")
+	}
+
+	return nil
+}
+
+// ipamAdd gets the container its addresses on the spartan network, from
+// the built-in allocator or by running the IPAM plugin.
+func (conf *NetConf) ipamAdd(args *skel.CmdArgs, spartanNetConf []byte) (types.Result, error) {
+	if conf.IPAM.Type == BuiltinIPAM {
+		return conf.Allocate(args)
+	}
+
+	return ipam.ExecAdd(conf.IPAM.Type, spartanNetConf)
+}
+
+// ipamDel releases the addresses of the container on the spartan network,
+// through the built-in allocator or by running the IPAM plugin.
+func (conf *NetConf) ipamDel(args *skel.CmdArgs, spartanNetConf []byte) error {
+	if conf.IPAM.Type == BuiltinIPAM {
+		return conf.Release(args)
+	}
+
+	return ipam.ExecDel(conf.IPAM.Type, spartanNetConf)
+}
+
+// ipamRelease releases the addresses that the interface `ifName` of the
+// container `containerID` got on the spartan network, by running the IPAM
+// plugin found in the CNI path of `args`. Unlike `ipamDel`, it doesn't
+// take the container from the CNI_* variables, so that GC can release the
+// addresses of containers that are gone.
+func (conf *NetConf) ipamRelease(args *skel.CmdArgs, containerID, ifName string, spartanNetConf []byte) error {
+	pluginPath, err := invoke.FindInPath(conf.IPAM.Type, filepath.SplitList(args.Path))
+	if err != nil {
+		return err
+	}
+
+	return invoke.ExecPluginWithoutResult(context.TODO(), pluginPath, spartanNetConf, &invoke.Args{
+		Command:     "DEL",
+		ContainerID: containerID,
+		IfName:      ifName,
+		Path:        args.Path,
+	}, nil)
+}
@@ -1,32 +1,193 @@
 package spartan
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
 	"net"
+	"path/filepath"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/ip"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+
+	"github.com/vishvananda/netlink"
 )
 
 type NetConf struct {
-	Enable bool `json:"enable", omitempty"`
+	Enable bool    `json:"enable,omitempty"`
+	DNS    DNSConf `json:"dns,omitempty"`
+	// IPs of the spartan nameservers, which the container reaches
+	// through the spartan interface. Defaults to `IPs`.
+	IPs []net.IP `json:"ips,omitempty"`
+	// Name of a host interface from which to discover the spartan
+	// nameserver IPs. When set, the /32 and /128 addresses assigned to
+	// that interface replace `IPs`.
+	Discover string `json:"discover,omitempty"`
+	// Name of the spartan interface in the container. Defaults to
+	// `IfName`.
+	Interface string `json:"interface,omitempty"`
+	// IPAM configuration of the spartan network. Fields that are not set
+	// default to those of `DefaultIPAM`.
+	IPAM IPAM `json:"ipam,omitempty"`
+	// Probe of the spartan nameservers from the container, once it is
+	// attached to the spartan network.
+	Probe ProbeConf `json:"probe,omitempty"`
+	// What to do about the host interface carrying the spartan IPs
+	// before attaching a container: `HostInterfaceVerify` checks that it
+	// carries all of them, `HostInterfaceCreate` creates it and assigns
+	// them as needed. By default it is left to whatever runs spartan.
+	HostInterface string `json:"hostInterface,omitempty"`
+	// Redirection of the DNS queries that the container sends to other
+	// nameservers to spartan.
+	DNAT DNATConf `json:"dnat,omitempty"`
+}
+
+// Modes of handling the host interface carrying the spartan IPs.
+const (
+	HostInterfaceVerify = "verify"
+	HostInterfaceCreate = "create"
+)
+
+// NewNetConf returns the configuration of the spartan network used
+// unless the operator overrides it.
+func NewNetConf() *NetConf {
+	conf := &NetConf{
+		Enable:    true,
+		Interface: IfName,
+		IPAM:      DefaultIPAM,
+	}
+
+	for _, spartanIP := range IPs {
+		conf.IPs = append(conf.IPs, spartanIP.IP)
+	}
+
+	return conf
+}
+
+// DNSConf controls how the DNS section of the CNI result is rewritten to
+// point the container at spartan.
+type DNSConf struct {
+	// Search domains to hand to the container. If empty, the search
+	// domains returned by the delegate plugin are kept.
+	Search []string `json:"search,omitempty"`
+	// Resolver options, such as `ndots:2`. If empty, the options
+	// returned by the delegate plugin are kept.
+	Options []string `json:"options,omitempty"`
+	// Keep the nameservers returned by the delegate plugin, after the
+	// spartan IPs, as fallbacks.
+	Fallback bool `json:"fallback,omitempty"`
+	// Nameserver to fall back to, listed right after the spartan IPs.
+	FallbackNameserver net.IP `json:"fallbackNameserver,omitempty"`
+	// Directory in which to write a resolv.conf for each container, in a
+	// subdirectory named after the container ID, for containers that
+	// ignore the DNS section of the CNI result. Disabled if empty.
+	ResolvConfDir string `json:"resolvConfDir,omitempty"`
+}
+
+// DNATConf controls whether the container's DNS queries are redirected to
+// spartan, for containers that pick their own nameservers.
+type DNATConf struct {
+	// Redirect DNS queries to other nameservers to spartan.
+	Enable bool `json:"enable,omitempty"`
+	// Destinations that the container can still query directly.
+	Exempt []types.IPNet `json:"exempt,omitempty"`
 }
 
+// ProbeConf controls whether ADD checks that the container gets an answer
+// from the spartan nameservers, and what happens when it doesn't.
+type ProbeConf struct {
+	// `ProbeWarn` to log nameservers that don't answer, or `ProbeFail`
+	// to fail the ADD. The probe is disabled if empty.
+	Policy string `json:"policy,omitempty"`
+	// How long to wait for the nameservers to answer, in milliseconds.
+	// Defaults to `DefaultProbeTimeout`.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Policies of the probe of the spartan nameservers.
+const (
+	ProbeWarn = "warn"
+	ProbeFail = "fail"
+)
+
+// DefaultProbeTimeout is how long the probe waits for the spartan
+// nameservers to answer unless told otherwise.
+const DefaultProbeTimeout = 500 * time.Millisecond
+
 type IPAM struct {
-	Type       string      `json:"type"`
-	RangeStart net.IP      `json:"rangeStart"`
-	RangeEnd   net.IP      `json:"rangeEnd"`
+	// IPAM plugin that allocates the addresses of the spartan network,
+	// or `BuiltinIPAM` to allocate them without running a plugin.
+	Type       string      `json:"type,omitempty"`
+	RangeStart net.IP      `json:"rangeStart,omitempty"`
+	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`
+	Subnet     types.IPNet `json:"subnet"`
+	// Additional range sets, in the format of the host-local IPAM
+	// plugin. The container gets an address from each of them, so an
+	// IPv6 range set makes the spartan network dual-stack.
+	Ranges [][]Range `json:"ranges,omitempty"`
+	// Directory in which the host-local IPAM plugin, or the built-in
+	// allocator, keeps its leases. Defaults to the host-local default,
+	// `/var/lib/cni/networks`.
+	DataDir string `json:"dataDir,omitempty"`
+}
+
+// UnmarshalJSON decodes the IPAM configuration over the current one,
+// usually `DefaultIPAM`. The default range only makes sense within the
+// default subnet, so a configuration that sets `subnet` without
+// `rangeStart` or `rangeEnd` gets the start or end of its subnet instead.
+func (i *IPAM) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	if _, ok := fields["subnet"]; ok {
+		i.RangeStart = nil
+		i.RangeEnd = nil
+	}
+
+	type ipam IPAM
+	return json.Unmarshal(data, (*ipam)(i))
+}
+
+// Range is a range of addresses to allocate from. If the start or the
+// end of the range are not set, they default to the start and end of the
+// subnet.
+type Range struct {
 	Subnet     types.IPNet `json:"subnet"`
+	RangeStart net.IP      `json:"rangeStart,omitempty"`
+	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`
 }
 
 type Network struct {
-	Name      string `json:"name"`
-	Interface string `json:"spartanInterface"`
-	IPAM      IPAM   `json:"ipam"`
+	CNIVersion string `json:"cniVersion,omitempty"`
+	Name       string `json:"name"`
+	Interface  string `json:"spartanInterface"`
+	IPAM       IPAM   `json:"ipam"`
 }
 
+// IfName is the name of the spartan interface on the host, and the
+// default name of the spartan interface in the container.
 const IfName string = "spartan"
 
-// TODO(asridharan): This needs to be derived from the spartan
-// configuration.
+// NetworkName is the name of the network that the spartan IPAM plugin
+// allocates addresses for.
+const NetworkName = "spartan-network"
+
+// DefaultDataDir is where the host-local IPAM plugin keeps its leases
+// unless told otherwise.
+const DefaultDataDir = "/var/lib/cni/networks"
+
+// BuiltinIPAM is the IPAM type that selects the allocator built into the
+// plugin. It keeps its leases in the same format and location as the
+// host-local IPAM plugin, so that a network can switch between the two.
+const BuiltinIPAM = "builtin"
+
+// IPs are the default spartan nameserver IPs.
 var IPs = []net.IPNet{
 	net.IPNet{
 		IP:   net.IPv4(198, 51, 100, 1),
@@ -46,18 +207,290 @@ var IPs = []net.IPNet{
 	},
 }
 
-// TODO(asridharan): This needs to be derived from the spartan
-// configuration.
-var Config = Network{
-	Name:      "spartan-network",
-	Interface: IfName,
-	IPAM: IPAM{
-		Type:       "host-local",
-		RangeStart: net.IPv4(198, 51, 100, 10),
-		RangeEnd:   net.IPv4(198, 51, 100, 253),
-		Subnet: types.IPNet{
-			IP:   net.IPv4(198, 51, 100, 0),
-			Mask: net.IPv4Mask(0xff, 0xff, 0xff, 0),
-		},
+// DefaultIPAM is the default IPAM configuration of the spartan network.
+var DefaultIPAM = IPAM{
+	Type:       "host-local",
+	RangeStart: net.IPv4(198, 51, 100, 10),
+	RangeEnd:   net.IPv4(198, 51, 100, 253),
+	Subnet: types.IPNet{
+		IP:   net.IPv4(198, 51, 100, 0),
+		Mask: net.IPv4Mask(0xff, 0xff, 0xff, 0),
 	},
 }
+
+// hostMask returns the mask of a host route to `addr`, a /32 for IPv4
+// and a /128 for IPv6.
+func hostMask(addr net.IP) net.IPMask {
+	if addr.To4() != nil {
+		return ipNetMask_32
+	}
+
+	return net.CIDRMask(128, 128)
+}
+
+// isHostMask returns true if `mask` is the mask of a host route.
+func isHostMask(mask net.IPMask) bool {
+	ones, bits := mask.Size()
+	return bits != 0 && ones == bits
+}
+
+// sameFamily returns true if `a` and `b` are both IPv4, or both IPv6.
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+// hostIfName returns the name of the host interface carrying the spartan
+// IPs.
+func (conf *NetConf) hostIfName() string {
+	if conf.Discover != "" {
+		return conf.Discover
+	}
+
+	return IfName
+}
+
+// Nameservers returns the spartan nameserver IPs as host routes.
+func (conf *NetConf) Nameservers() []net.IPNet {
+	var nameservers []net.IPNet
+	for _, ip := range conf.IPs {
+		nameservers = append(nameservers, net.IPNet{IP: ip, Mask: hostMask(ip)})
+	}
+
+	return nameservers
+}
+
+// rangeSets returns the range sets that the container gets an address
+// from, starting with the IPv4 range set at the top of the IPAM
+// configuration.
+func (conf *NetConf) rangeSets() [][]Range {
+	rangeSets := [][]Range{{{
+		Subnet:     conf.IPAM.Subnet,
+		RangeStart: conf.IPAM.RangeStart,
+		RangeEnd:   conf.IPAM.RangeEnd,
+	}}}
+
+	return append(rangeSets, conf.IPAM.Ranges...)
+}
+
+// hasRangeSet returns true if the spartan network has a range set of the
+// address family of `addr`.
+func (conf *NetConf) hasRangeSet(addr net.IP) bool {
+	for _, rangeSet := range conf.rangeSets() {
+		if len(rangeSet) > 0 && sameFamily(rangeSet[0].Subnet.IP, addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inNetwork returns true if `addr` lies within one of the subnets of the
+// spartan network.
+func (conf *NetConf) inNetwork(addr net.IP) bool {
+	for _, rangeSet := range conf.rangeSets() {
+		for _, r := range rangeSet {
+			subnet := net.IPNet(r.Subnet)
+			if subnet.Contains(addr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// bounds returns the first and the last address of the range.
+func (r *Range) bounds() (net.IP, net.IP) {
+	subnet := net.IPNet(r.Subnet)
+
+	start := r.RangeStart
+	if start == nil {
+		start = ip.NextIP(subnet.IP.Mask(subnet.Mask))
+	}
+
+	end := r.RangeEnd
+	if end == nil {
+		end = ip.PrevIP(lastIP(subnet))
+	}
+
+	return start, end
+}
+
+// lastIP returns the last address of `subnet`.
+func lastIP(subnet net.IPNet) net.IP {
+	addr := subnet.IP.Mask(subnet.Mask)
+	last := make(net.IP, len(addr))
+	for i := range addr {
+		last[i] = addr[i] | ^subnet.Mask[i]
+	}
+
+	return last
+}
+
+// validate checks that the range lies within its subnet.
+func (r *Range) validate() error {
+	subnet := net.IPNet(r.Subnet)
+	if subnet.IP == nil || subnet.Mask == nil {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, "spartan range is missing a subnet", "")
+	}
+
+	start, end := r.bounds()
+	for _, addr := range []net.IP{start, end} {
+		if !subnet.Contains(addr) {
+			msg := fmt.Sprintf("spartan range %s-%s is not within subnet %s", start, end, subnet.String())
+			return cnierrors.New(cnierrors.ErrInvalidConfig, msg, "")
+		}
+	}
+
+	if ip.Cmp(start, end) > 0 {
+		msg := fmt.Sprintf("spartan range start %s is after range end %s", start, end)
+		return cnierrors.New(cnierrors.ErrInvalidConfig, msg, "")
+	}
+
+	return nil
+}
+
+// DiscoverIPs replaces the nameserver IPs with the /32 and /128 addresses
+// assigned to the host interface named by `Discover`. Addresses of a family
+// without a range set are dropped, since containers get no address to
+// reach them from. It does nothing unless discovery has been enabled.
+func (conf *NetConf) DiscoverIPs() error {
+	if conf.Discover == "" {
+		return nil
+	}
+
+	link, err := netlink.LinkByName(conf.Discover)
+	if err != nil {
+		return cnierrors.Link(err, fmt.Sprintf("failed to lookup host interface %q to discover spartan IPs", conf.Discover))
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return cnierrors.Link(err, fmt.Sprintf("failed to list addresses on %q", conf.Discover))
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if !isHostMask(addr.Mask) || !addr.IP.IsGlobalUnicast() {
+			continue
+		}
+
+		if !conf.hasRangeSet(addr.IP) {
+			log.Printf("Ignoring spartan IP %s discovered on %q, which has no range of its address family", addr.IP, conf.Discover)
+			continue
+		}
+
+		ips = append(ips, addr.IP)
+	}
+
+	if len(ips) == 0 {
+		msg := fmt.Sprintf("no /32 or /128 addresses with a spartan range of their family on host interface %q to use as spartan IPs", conf.Discover)
+		return cnierrors.New(cnierrors.ErrInterfaceFailure, msg, "")
+	}
+
+	conf.IPs = ips
+	return nil
+}
+
+// Validate checks that the spartan network is usable: the allocation
+// ranges have to lie within their subnets, there can be at most one
+// range set per address family, and every nameserver needs a range set
+// of its family while lying outside of its ranges.
+func (conf *NetConf) Validate() error {
+	// The nameserver IPs of a network using discovery are only known
+	// once they have been discovered.
+	if len(conf.IPs) == 0 && conf.Discover == "" {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, "no spartan nameserver IPs specified", "")
+	}
+
+	if err := utils.ValidateInterfaceName(conf.Interface); err != nil {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("invalid spartan interface name %q", conf.Interface), err.Msg)
+	}
+
+	// The resolv.conf files get bind-mounted into containers, so they
+	// can't depend on the working directory of the plugin.
+	if conf.DNS.ResolvConfDir != "" && !filepath.IsAbs(conf.DNS.ResolvConfDir) {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("resolv.conf directory %q is not an absolute path", conf.DNS.ResolvConfDir), "")
+	}
+
+	switch conf.HostInterface {
+	case "", HostInterfaceVerify:
+	case HostInterfaceCreate:
+		// Discovered IPs come from the very interface we would create.
+		if conf.Discover != "" {
+			return cnierrors.New(cnierrors.ErrInvalidConfig, "the spartan host interface can't be created when discovering the spartan IPs", "")
+		}
+	default:
+		return cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("unknown spartan host interface mode %q", conf.HostInterface), "")
+	}
+
+	switch conf.Probe.Policy {
+	case "", ProbeWarn, ProbeFail:
+	default:
+		return cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("unknown spartan probe policy %q", conf.Probe.Policy), "")
+	}
+
+	if conf.Probe.Timeout < 0 {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("invalid spartan probe timeout %d", conf.Probe.Timeout), "")
+	}
+
+	for _, exempt := range conf.DNAT.Exempt {
+		if exempt.IP == nil || exempt.Mask == nil {
+			return cnierrors.New(cnierrors.ErrInvalidConfig, "DNS redirection exemptions must be CIDRs", "")
+		}
+	}
+
+	if conf.IPAM.Type == "" {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, "no IPAM plugin specified for the spartan network", "")
+	}
+
+	subnet := net.IPNet(conf.IPAM.Subnet)
+	if subnet.IP.To4() == nil || subnet.Mask == nil {
+		return cnierrors.New(cnierrors.ErrInvalidConfig, "the spartan network requires an IPv4 subnet", "")
+	}
+
+	// The container gets an address from each range set, and we only
+	// know how to handle one address per family.
+	families := map[bool]bool{}
+	for _, rangeSet := range conf.rangeSets() {
+		if len(rangeSet) == 0 {
+			return cnierrors.New(cnierrors.ErrInvalidConfig, "empty range set in the spartan network", "")
+		}
+
+		for _, r := range rangeSet {
+			if err := r.validate(); err != nil {
+				return err
+			}
+
+			if !sameFamily(r.Subnet.IP, rangeSet[0].Subnet.IP) {
+				return cnierrors.New(cnierrors.ErrInvalidConfig, "range set of the spartan network mixes IPv4 and IPv6 ranges", "")
+			}
+		}
+
+		ipv6 := rangeSet[0].Subnet.IP.To4() == nil
+		if families[ipv6] {
+			return cnierrors.New(cnierrors.ErrInvalidConfig, "the spartan network has more than one range set per address family", "")
+		}
+
+		families[ipv6] = true
+	}
+
+	for _, nameserver := range conf.IPs {
+		if !families[nameserver.To4() == nil] {
+			msg := fmt.Sprintf("spartan nameserver %s has no range of its address family to reach it from", nameserver)
+			return cnierrors.New(cnierrors.ErrInvalidConfig, msg, "")
+		}
+
+		for _, rangeSet := range conf.rangeSets() {
+			for _, r := range rangeSet {
+				start, end := r.bounds()
+				if ip.Cmp(nameserver, start) >= 0 && ip.Cmp(nameserver, end) <= 0 {
+					msg := fmt.Sprintf("spartan nameserver %s lies within the range %s-%s", nameserver, start, end)
+					return cnierrors.New(cnierrors.ErrInvalidConfig, msg, "")
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package spartan
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/coreos/go-iptables/iptables"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+)
+
+// dnsChain is the chain of the nat table, in the container's network
+// namespace, that redirects DNS queries to spartan.
+const dnsChain = "SPARTAN-DNS"
+
+// dnsJumps are the rules sending the DNS queries of the container through
+// `dnsChain`.
+var dnsJumps = [][]string{
+	{"-p", "udp", "--dport", "53", "-j", dnsChain},
+	{"-p", "tcp", "--dport", "53", "-j", dnsChain},
+}
+
+// dnatFamily is the set of rules redirecting the DNS queries of one
+// address family.
+type dnatFamily struct {
+	proto iptables.Protocol
+	rules [][]string
+}
+
+// dnatFamilies returns the rules of `dnsChain` for each address family
+// that has a spartan IP. Queries to the spartan IPs, to the exempt
+// destinations and to the loopback stay as they are, and all other
+// queries go to the first spartan IP of their family.
+func (conf *NetConf) dnatFamilies() []dnatFamily {
+	var families []dnatFamily
+
+	for _, family := range []struct {
+		proto    iptables.Protocol
+		loopback string
+	}{
+		{iptables.ProtocolIPv4, "127.0.0.0/8"},
+		{iptables.ProtocolIPv6, "::1/128"},
+	} {
+		_, loopback, _ := net.ParseCIDR(family.loopback)
+
+		var target net.IP
+		rules := [][]string{{"-d", loopback.String(), "-j", "RETURN"}}
+		for _, spartanIP := range conf.Nameservers() {
+			if !sameFamily(spartanIP.IP, loopback.IP) {
+				continue
+			}
+
+			if target == nil {
+				target = spartanIP.IP
+			}
+			rules = append(rules, []string{"-d", spartanIP.String(), "-j", "RETURN"})
+		}
+
+		if target == nil {
+			continue
+		}
+
+		for _, exempt := range conf.DNAT.Exempt {
+			exempt := net.IPNet(exempt)
+			if sameFamily(exempt.IP, loopback.IP) {
+				rules = append(rules, []string{"-d", exempt.String(), "-j", "RETURN"})
+			}
+		}
+
+		for _, protocol := range []string{"udp", "tcp"} {
+			rules = append(rules, []string{"-p", protocol, "-j", "DNAT", "--to-destination", target.String()})
+		}
+
+		families = append(families, dnatFamily{proto: family.proto, rules: rules})
+	}
+
+	return families
+}
+
+// setupDNAT redirects the DNS queries of the container to spartan. It has
+// to be called from within the container's network namespace, and
+// replaces whatever rules a previous ADD left behind.
+func (conf *NetConf) setupDNAT() error {
+	for _, family := range conf.dnatFamilies() {
+		ipt, err := iptables.NewWithProtocol(family.proto)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, "failed to locate iptables")
+		}
+
+		if err := ipt.ClearChain("nat", dnsChain); err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to create chain %s", dnsChain))
+		}
+
+		for _, rule := range family.rules {
+			if err := ipt.Append("nat", dnsChain, rule...); err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to add rule %v to chain %s", rule, dnsChain))
+			}
+		}
+
+		for _, jump := range dnsJumps {
+			if err := ipt.AppendUnique("nat", "OUTPUT", jump...); err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to add rule %v to chain OUTPUT", jump))
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDNAT checks that the DNS queries of the container are redirected
+// to spartan. It has to be called from within the container's network
+// namespace.
+func (conf *NetConf) checkDNAT() error {
+	for _, family := range conf.dnatFamilies() {
+		ipt, err := iptables.NewWithProtocol(family.proto)
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, "failed to locate iptables")
+		}
+
+		for _, rule := range family.rules {
+			exists, err := ipt.Exists("nat", dnsChain, rule...)
+			if err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to look up rule %v in chain %s", rule, dnsChain))
+			}
+
+			if !exists {
+				return cnierrors.New(cnierrors.ErrFirewallFailure, fmt.Sprintf("rule %v is missing from chain %s", rule, dnsChain), "")
+			}
+		}
+
+		for _, jump := range dnsJumps {
+			exists, err := ipt.Exists("nat", "OUTPUT", jump...)
+			if err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to look up rule %v in chain OUTPUT", jump))
+			}
+
+			if !exists {
+				return cnierrors.New(cnierrors.ErrFirewallFailure, fmt.Sprintf("rule %v is missing from chain OUTPUT", jump), "")
+			}
+		}
+	}
+
+	return nil
+}
+
+// tearDownDNAT stops redirecting the DNS queries of the container to
+// spartan. A network namespace or chain that is already gone is not an
+// error, so that DEL can be retried.
+func (conf *NetConf) tearDownDNAT(netns string) error {
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		for _, family := range conf.dnatFamilies() {
+			ipt, err := iptables.NewWithProtocol(family.proto)
+			if err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, "failed to locate iptables")
+			}
+
+			exists, err := ipt.ChainExists("nat", dnsChain)
+			if err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to look up chain %s", dnsChain))
+			}
+
+			if !exists {
+				continue
+			}
+
+			for _, jump := range dnsJumps {
+				if err := ipt.DeleteIfExists("nat", "OUTPUT", jump...); err != nil {
+					return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to delete rule %v from chain OUTPUT", jump))
+				}
+			}
+
+			if err := ipt.ClearAndDeleteChain("nat", dnsChain); err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrFirewallFailure, fmt.Sprintf("failed to delete chain %s", dnsChain))
+			}
+		}
+
+		return nil
+	})
+
+	// Once the network namespace is unmounted, its path is either gone
+	// or a plain file.
+	switch err.(type) {
+	case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		return nil
+	}
+
+	if err != nil {
+		return cnierrors.Netns(err, fmt.Sprintf("unable to remove DNS redirection in netns(%s)", netns))
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package spartan
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+)
+
+// OverrideDNS returns a copy of `dns` that uses the spartan IPs as
+// nameservers, followed by the fallback nameserver if one has been
+// configured. Search domains and options are replaced if they have been
+// configured, and the original nameservers are kept after the spartan IPs
+// only if fallback has been requested.
+func (conf *NetConf) OverrideDNS(dns types.DNS) types.DNS {
+	result := types.DNS{
+		Domain:  dns.Domain,
+		Search:  dns.Search,
+		Options: dns.Options,
+	}
+
+	for _, spartanIP := range conf.IPs {
+		result.Nameservers = append(result.Nameservers, spartanIP.String())
+	}
+
+	if conf.DNS.FallbackNameserver != nil {
+		nameserver := conf.DNS.FallbackNameserver.String()
+		if !contains(result.Nameservers, nameserver) {
+			result.Nameservers = append(result.Nameservers, nameserver)
+		}
+	}
+
+	if conf.DNS.Fallback {
+		for _, nameserver := range dns.Nameservers {
+			if !contains(result.Nameservers, nameserver) {
+				result.Nameservers = append(result.Nameservers, nameserver)
+			}
+		}
+	}
+
+	if len(conf.DNS.Search) > 0 {
+		result.Search = conf.DNS.Search
+	}
+
+	if len(conf.DNS.Options) > 0 {
+		result.Options = conf.DNS.Options
+	}
+
+	return result
+}
+
+// ResolvConfPath returns the path of the resolv.conf written for the
+// container, or an empty string unless resolv.conf files have been
+// enabled.
+func (conf *NetConf) ResolvConfPath(containerID string) string {
+	if conf.DNS.ResolvConfDir == "" || containerID == "" {
+		return ""
+	}
+
+	return filepath.Join(conf.DNS.ResolvConfDir, containerID, "resolv.conf")
+}
+
+// WriteResolvConf writes the resolv.conf of the container, pointing it at
+// the nameservers, search domains and options of `dns`, and returns its
+// path. It does nothing unless resolv.conf files have been enabled.
+func (conf *NetConf) WriteResolvConf(containerID string, dns types.DNS) (string, error) {
+	path := conf.ResolvConfPath(containerID)
+	if path == "" {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by the dcos-l4lb CNI plugin for container %s\n", containerID)
+
+	for _, nameserver := range dns.Nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", nameserver)
+	}
+
+	// The resolver only honours whichever of `domain` and `search` comes
+	// last, so only write one of them.
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(dns.Search, " "))
+	} else if dns.Domain != "" {
+		fmt.Fprintf(&buf, "domain %s\n", dns.Domain)
+	}
+
+	if len(dns.Options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(dns.Options, " "))
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to create resolv.conf directory %s", dir))
+	}
+
+	// Write to a temporary file first, so that a container never sees a
+	// partially written resolv.conf.
+	f, err := ioutil.TempFile(dir, ".resolv.conf-")
+	if err != nil {
+		return "", cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to create resolv.conf in %s", dir))
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if _err := f.Close(); err == nil {
+		err = _err
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		return "", cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to write %s", path))
+	}
+
+	return path, nil
+}
+
+// RemoveResolvConf removes the resolv.conf of the container, along with
+// its directory. A resolv.conf that is already gone is not an error.
+func (conf *NetConf) RemoveResolvConf(containerID string) error {
+	path := conf.ResolvConfPath(containerID)
+	if path == "" {
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.RemoveAll(dir); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to remove resolv.conf directory %s", dir))
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+package spartan
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// checkHostInterface checks that the host interface carrying the spartan
+// IPs carries all of them, and reports the problems it finds with `code`.
+func (conf *NetConf) checkHostInterface(code uint) error {
+	hostIfName := conf.hostIfName()
+
+	link, err := netlink.LinkByName(hostIfName)
+	if err != nil {
+		return cnierrors.New(code, fmt.Sprintf("spartan interface %q not found on the host", hostIfName), err.Error())
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return cnierrors.New(code, fmt.Sprintf("failed to list addresses on %q", hostIfName), err.Error())
+	}
+
+	for _, spartanIP := range conf.Nameservers() {
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == spartanIP.String() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			msg := fmt.Sprintf("spartan IP %s is missing from %q", spartanIP.String(), hostIfName)
+			return cnierrors.New(code, msg, "")
+		}
+	}
+
+	return nil
+}
+
+// CreateHostInterface creates the `spartan` dummy interface on the host
+// and assigns it the spartan IPs, unless it already exists and carries
+// them. It can be called any number of times, including concurrently.
+func (conf *NetConf) CreateHostInterface() error {
+	link, err := netlink.LinkByName(IfName)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: IfName}}
+		err = netlink.LinkAdd(dummy)
+
+		// Someone else might have beaten us to it.
+		if err == nil || os.IsExist(err) {
+			link, err = netlink.LinkByName(IfName)
+		}
+
+		if err == nil {
+			log.Println("Created spartan host interface", IfName)
+		}
+	}
+
+	if err != nil {
+		return cnierrors.Link(err, fmt.Sprintf("failed to set up spartan host interface %q", IfName))
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return cnierrors.Link(err, fmt.Sprintf("failed to set %q UP", IfName))
+	}
+
+	for _, spartanIP := range conf.Nameservers() {
+		spartanIP := spartanIP
+
+		// Nothing else can be using the spartan IPs, so skip IPv6
+		// duplicate address detection.
+		addr := &netlink.Addr{IPNet: &spartanIP}
+		if spartanIP.IP.To4() == nil {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+
+		err := netlink.AddrAdd(link, addr)
+		if os.IsExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, fmt.Sprintf("failed to add spartan IP %s to %q", spartanIP.IP, IfName))
+		}
+
+		log.Printf("Added spartan IP %s to %s", spartanIP.IP, IfName)
+	}
+
+	return nil
+}
+
+// ensureHostInterface verifies or creates the host interface carrying
+// the spartan IPs, as configured.
+func (conf *NetConf) ensureHostInterface() error {
+	switch conf.HostInterface {
+	case HostInterfaceVerify:
+		return conf.checkHostInterface(cnierrors.ErrInterfaceFailure)
+	case HostInterfaceCreate:
+		return conf.CreateHostInterface()
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package spartan
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+	"github.com/dcos/dcos-cni/pkg/registry"
+)
+
+// Owners returns the registry recording, for each container holding
+// spartan leases, the name of the network it got them on, followed by the
+// name of the interface it got them for. Every dcos-l4lb network on the
+// host shares the spartan lease store, so this is what keeps GC of one
+// network away from the leases of the others. The records live next to
+// the lease store rather than in it, where the host-local IPAM plugin
+// would trip over them.
+func (conf *NetConf) Owners() *registry.Registry {
+	return registry.New(filepath.Join(conf.dataDir(), NetworkName+".owners"))
+}
+
+// ownerRecord returns the owner record of the leases that the interface
+// `ifName` of a container got on `network`. Like a host-local lease, it
+// holds one field per line.
+func ownerRecord(network, ifName string) []byte {
+	return []byte(network + disk.LineBreak + ifName)
+}
+
+// parseOwnerRecord returns the network and interface name of an owner
+// record. Records written by earlier versions only hold the network.
+func parseOwnerRecord(data []byte) (network, ifName string) {
+	parts := strings.SplitN(string(data), disk.LineBreak, 2)
+	if len(parts) == 2 {
+		ifName = parts[1]
+	}
+
+	return parts[0], ifName
+}
+
+// vethAlias returns the alias of the host end of the spartan veth of the
+// container on `network`.
+func vethAlias(network, containerID string) string {
+	return network + "/" + containerID
+}
+
+// vethNetwork returns the network named in the alias of the host end of a
+// spartan veth. Veths set up by earlier versions only carry the container
+// ID, and belong to no network we can tell.
+func vethNetwork(alias string) string {
+	parts := strings.SplitN(alias, "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	return parts[0]
+}
+
+// staleContainers returns the containers that got their spartan leases on
+// `network`, but are not in `containerIDs`, along with the name of the
+// interface they got them for.
+func (conf *NetConf) staleContainers(network string, containerIDs map[string]bool) (map[string]string, error) {
+	owners := conf.Owners()
+	ids, err := owners.List()
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to list the owners of spartan leases in %s", owners.Dir()))
+	}
+
+	stale := map[string]string{}
+	for _, id := range ids {
+		if containerIDs[id] {
+			continue
+		}
+
+		record, err := owners.Get(id)
+
+		// The container might have been deleted since we listed the
+		// owners.
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to read the owner of the spartan leases of containerID %s", id))
+		}
+
+		if owner, ifName := parseOwnerRecord(record.Data); owner == network {
+			stale[id] = ifName
+		}
+	}
+
+	return stale, nil
+}
+
+// removeOwners removes the owner records of `containerIDs`.
+func (conf *NetConf) removeOwners(containerIDs map[string]string) error {
+	owners := conf.Owners()
+	for containerID := range containerIDs {
+		if _, err := owners.Delete(containerID); err != nil {
+			return cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to remove the owner of the spartan leases of containerID %s", containerID))
+		}
+
+		log.Println("Removed spartan lease owner of stale containerID", containerID)
+	}
+
+	return nil
+}
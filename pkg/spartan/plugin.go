@@ -1,29 +1,50 @@
 package spartan
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/containernetworking/cni/pkg/ip"
-	"github.com/containernetworking/cni/pkg/ipam"
-	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 var ipNetMask_32 net.IPMask = net.IPv4Mask(0xff, 0xff, 0xff, 0xff)
 
-type Error string
-
-func (err Error) Error() string {
-	return "spartan: " + string(err)
+// hostVethPrefix prefixes the names of the host ends of spartan veths. It
+// is kept short to leave room in IFNAMSIZ for the hash identifying the
+// container.
+const hostVethPrefix = "spt"
+
+// HostVethName returns the name of the host end of the spartan veth of a
+// container attached to its network as `ifName`. The name is derived from
+// the container ID and `ifName`, since that is all DEL and GC have to go
+// by once the container's network namespace is gone. Since the hash is
+// truncated, two containers might still end up with the same name, so the
+// veth is only ever removed by the container named in its alias.
+func HostVethName(containerID, ifName string) string {
+	sum := sha256.Sum256([]byte(containerID + "/" + ifName))
+	return fmt.Sprintf("%s%x", hostVethPrefix, sum[:6])
 }
 
-func setupContainerVeth(netns, ifName string, mtu int, pr current.Result, spartanIPs []net.IPNet) (string, error) {
+func setupContainerVeth(netns, ifName, hostVethName string, mtu int, pr current.Result, spartanIPs []net.IPNet) (*current.Interface, *current.Interface, error) {
 	// The IPAM result will be something like IP=192.168.3.5/24,
 	// GW=192.168.3.1. What we want is really a point-to-point link but
 	// veth does not support IFF_POINTOPONT. So we set the veth
@@ -31,147 +52,847 @@ func setupContainerVeth(netns, ifName string, mtu int, pr current.Result, sparta
 	// /32, this would not add any routes to the main routing table.
 	// Therefore, in order to reach the spartan interfaces, we will have
 	// to explicitly set routes to the spartan interface through this
-	// device.
+	// device. IPv6 addresses are handled the same way, with a /128.
 
-	var hostVethName string
+	hostIface := &current.Interface{}
+	containerIface := &current.Interface{}
 
 	err := ns.WithNetNSPath(netns, func(hostNS ns.NetNS) error {
-		hostVeth, _, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, contVeth, err := ip.SetupVethWithName(ifName, hostVethName, mtu, "", hostNS)
 		if err != nil {
-			return err
+			return cnierrors.Link(err, "unable to create veth pair")
 		}
 
 		containerVeth, err := netlink.LinkByName(ifName)
 		if err != nil {
-			return fmt.Errorf("failed to lookup container VETH %q: %s", ifName, err)
+			return cnierrors.Link(err, fmt.Sprintf("failed to lookup container VETH %q", ifName))
+		}
+
+		for _, ipc := range pr.IPs {
+			if ipc.Address.IP.To4() != nil {
+				continue
+			}
+
+			// The runtime might have disabled IPv6 in the container.
+			if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", ifName), "0"); err != nil {
+				return cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, fmt.Sprintf("failed to enable IPv6 on %q", ifName))
+			}
+			break
 		}
 
 		// Configure the container veth with IP address returned by the
 		// IPAM, but set the netmask to a /32.
 		if err := netlink.LinkSetUp(containerVeth); err != nil {
-			return fmt.Errorf("failed to set %q UP: %s", ifName, err)
+			return cnierrors.Link(err, fmt.Sprintf("failed to set %q UP", ifName))
 		}
 
-		// Set the netmask to a /32.
-		pr.IPs[0].Address.Mask = ipNetMask_32
+		for _, ipc := range pr.IPs {
+			// Set the netmask to a /32, or a /128 for IPv6.
+			ipc.Address.Mask = hostMask(ipc.Address.IP)
+
+			// Nobody else can be using the address on this veth, so skip
+			// IPv6 duplicate address detection, which would keep the
+			// address unusable for a while.
+			addr := &netlink.Addr{IPNet: &ipc.Address, Label: ""}
+			if ipc.Address.IP.To4() == nil {
+				addr.Flags = unix.IFA_F_NODAD
+			}
 
-		addr := &netlink.Addr{IPNet: &pr.IPs[0].Address, Label: ""}
-		if err = netlink.AddrAdd(containerVeth, addr); err != nil {
-			return fmt.Errorf("failed to add IP address to %q: %s", ifName, err)
+			if err = netlink.AddrAdd(containerVeth, addr); err != nil {
+				return cnierrors.Link(err, fmt.Sprintf("failed to add IP address to %q", ifName))
+			}
 		}
 
 		// Add routes to the spartan interfaces through this interface.
 		for _, spartanIP := range spartanIPs {
+			var src net.IP
+			for _, ipc := range pr.IPs {
+				if sameFamily(ipc.Address.IP, spartanIP.IP) {
+					src = ipc.Address.IP
+					break
+				}
+			}
+
+			if src == nil {
+				msg := fmt.Sprintf("no address to reach spartan IP %s from", spartanIP.IP)
+				return cnierrors.New(cnierrors.ErrIPAMFailure, msg, "")
+			}
+
 			spartanRoute := netlink.Route{
 				LinkIndex: containerVeth.Attrs().Index,
 				Dst:       &spartanIP,
 				Scope:     netlink.SCOPE_LINK,
-				Src:       pr.IPs[0].Address.IP,
+				Src:       src,
 			}
 
 			if err = netlink.RouteAdd(&spartanRoute); err != nil {
-				return fmt.Errorf("failed to add spartan route %s: %s", spartanRoute, err)
+				return cnierrors.Link(err, fmt.Sprintf("failed to add spartan route %s", spartanRoute))
+			}
+
+			// The host only answers neighbour solicitations for
+			// addresses of the interface they arrive on, which the
+			// spartan IPs are not. Point the container at the host veth
+			// directly instead.
+			if spartanIP.IP.To4() == nil {
+				neigh := &netlink.Neigh{
+					LinkIndex:    containerVeth.Attrs().Index,
+					Family:       netlink.FAMILY_V6,
+					State:        netlink.NUD_PERMANENT,
+					IP:           spartanIP.IP,
+					HardwareAddr: hostVeth.HardwareAddr,
+				}
+
+				if err = netlink.NeighAdd(neigh); err != nil {
+					return cnierrors.Link(err, fmt.Sprintf("failed to add neighbour entry for spartan IP %s", spartanIP.IP))
+				}
 			}
 		}
 
-		hostVethName = hostVeth.Name
+		hostIface.Name = hostVeth.Name
+		hostIface.Mac = hostVeth.HardwareAddr.String()
+		containerIface.Name = contVeth.Name
+		containerIface.Mac = contVeth.HardwareAddr.String()
+		containerIface.Sandbox = netns
 
 		return nil
 	})
 
-	return hostVethName, err
+	return hostIface, containerIface, err
+}
+
+// ipamNetConf returns the configuration of the spartan network to hand to
+// the IPAM plugin. It carries the `cniVersion` of the configuration in
+// `args`, so that the IPAM plugin returns a result in the version that
+// the runtime asked for.
+func (conf *NetConf) ipamNetConf(args *skel.CmdArgs) ([]byte, error) {
+	cniVersion, err := (&version.ConfigDecoder{}).Decode(args.StdinData)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrDecodingFailure, "failed to decode the CNI version")
+	}
+
+	network := Network{
+		CNIVersion: cniVersion,
+		Name:       NetworkName,
+		Interface:  conf.Interface,
+		IPAM:       conf.IPAM,
+	}
+
+	spartanNetConf, err := json.Marshal(network)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInvalidConfig, "failed to marshall the `spartan-network` IPAM configuration")
+	}
+
+	return spartanNetConf, nil
+}
+
+// tearDownContainerVeth removes the spartan veth from the container, and
+// reports whether there was a veth to remove. A network namespace or
+// interface that is already gone is not an error, so that DEL can be
+// retried.
+func tearDownContainerVeth(netns, ifName string) (bool, error) {
+	removed := false
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		// We just need to delete the interface, the associated routes
+		// will get deleted by themselves.
+		_, err := ip.DelLinkByNameAddr(ifName)
+		if err == ip.ErrLinkNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to delete %q", ifName))
+		}
+
+		removed = true
+		return nil
+	})
+
+	// Once the network namespace is unmounted, its path is either gone
+	// or a plain file.
+	switch err.(type) {
+	case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+		return false, nil
+	}
+
+	if err != nil {
+		return false, cnierrors.Netns(err, fmt.Sprintf("unable to remove spartan interface in netns(%s)", netns))
+	}
+
+	return removed, nil
+}
+
+// vethMTU returns the MTU of the spartan veth. Unless `mtu` has been
+// configured, the spartan veth takes the MTU of the interface that the
+// delegate plugin, or the previous plugin in the chain, set up in the
+// container, so that it matches the rest of the container's network.
+// Failing that, it takes the MTU of the host interface carrying the
+// spartan IPs.
+func (conf *NetConf) vethMTU(args *skel.CmdArgs, mtu int) (int, error) {
+	switch {
+	case mtu < 0:
+		return 0, cnierrors.New(cnierrors.ErrInvalidConfig, fmt.Sprintf("invalid MTU %d", mtu), "")
+	case mtu > 0:
+		return mtu, nil
+	}
+
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return err
+		}
+
+		mtu = link.Attrs().MTU
+		return nil
+	})
+
+	if err == nil && mtu > 0 {
+		return mtu, nil
+	}
+
+	link, err := netlink.LinkByName(conf.hostIfName())
+	if err == nil {
+		return link.Attrs().MTU, nil
+	}
+
+	// Let the kernel pick the MTU.
+	return 0, nil
+}
+
+// tearDownHostVeth removes the host end of the spartan veth of the
+// container `containerID` on `network`, and reports whether there was one
+// to remove. A veth by that name whose alias names another container is
+// left alone, since its name only collides with ours. Removing either end
+// of a veth removes the other, so this also removes the container end if
+// the container's network namespace is still around.
+func tearDownHostVeth(name, network, containerID string) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+
+		return false, cnierrors.Link(err, fmt.Sprintf("failed to lookup host VETH %q", name))
+	}
+
+	// Veths set up by earlier versions only carry the container ID.
+	alias := link.Attrs().Alias
+	if alias != vethAlias(network, containerID) && alias != containerID {
+		log.Printf("Leaving host VETH %q alone, it belongs to %q", name, alias)
+		return false, nil
+	}
+
+	if err = netlink.LinkDel(link); err != nil {
+		return false, cnierrors.Link(err, fmt.Sprintf("failed to delete host VETH %q", name))
+	}
+
+	return true, nil
 }
 
-func CniAdd(args *skel.CmdArgs) error {
+// CniAdd attaches the container to the spartan network on behalf of the
+// dcos-l4lb `network`, and returns a result describing the spartan veth
+// pair, the address assigned to the container end and the routes to the
+// spartan IPs. Both ends of the veth get `mtu`, or the MTU picked by
+// `vethMTU` if it is 0.
+func CniAdd(args *skel.CmdArgs, conf *NetConf, network string, mtu int) (_ *current.Result, err error) {
+	if err := conf.DiscoverIPs(); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Without the spartan IPs on the host, the container would get
+	// routes to nowhere.
+	if err := conf.ensureHostInterface(); err != nil {
+		return nil, err
+	}
+
 	// Delegate plugin seems to be successful, install the spartan
 	// network.
-	spartanNetConf, err := json.Marshal(Config)
+	spartanNetConf, err := conf.ipamNetConf(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// ADD might be retried for the same container. Replace whatever a
+	// previous ADD left behind, since the IPAM plugin will refuse to
+	// allocate a second address to the same container.
+	removed, err := tearDownContainerVeth(args.Netns, conf.Interface)
 	if err != nil {
-		return Error(fmt.Sprintf("failed to marshall the `spartan-network` IPAM configuration: %s", err))
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, "failed to remove existing spartan interface")
+	}
+
+	if removed {
+		log.Printf("Replacing existing spartan interface in netns(%s)", args.Netns)
+	}
+
+	hostVethName := HostVethName(args.ContainerID, args.IfName)
+	removed, err = tearDownHostVeth(hostVethName, network, args.ContainerID)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, "failed to remove existing spartan host interface")
+	}
+
+	if removed {
+		log.Println("Replacing existing spartan host interface", hostVethName)
+	}
+
+	if err = conf.ipamDel(args, spartanNetConf); err != nil {
+		return nil, cnierrors.IPAM(err, "failed to release existing IP address")
 	}
 
-	// Run the IPAM plugin for the spartan network.
-	ipamResult, err := ipam.ExecAdd(Config.IPAM.Type, spartanNetConf)
+	// Record the network the leases are for before getting them, so that
+	// GC of another network never mistakes them for its own.
+	if err = conf.Owners().Put(args.ContainerID, ownerRecord(network, args.IfName)); err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to record the owner of the spartan leases")
+	}
+
+	// If we fail to attach the container past this point, release the
+	// lease and remove the veth so that a failed launch does not leak
+	// addresses from the spartan network.
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if conf.DNAT.Enable {
+			if _err := conf.tearDownDNAT(args.Netns); _err != nil {
+				log.Printf("failed to remove DNS redirection while rolling back: %s", _err)
+			}
+		}
+
+		if _, _err := tearDownContainerVeth(args.Netns, conf.Interface); _err != nil {
+			log.Printf("failed to remove spartan interface while rolling back: %s", _err)
+		}
+
+		if _, _err := tearDownHostVeth(hostVethName, network, args.ContainerID); _err != nil {
+			log.Printf("failed to remove spartan host interface while rolling back: %s", _err)
+		}
+
+		if _err := conf.ipamDel(args, spartanNetConf); _err != nil {
+			log.Printf("failed to release spartan IP while rolling back: %s", _err)
+		}
+
+		if _, _err := conf.Owners().Delete(args.ContainerID); _err != nil {
+			log.Printf("failed to remove the owner of the spartan leases while rolling back: %s", _err)
+		}
+	}()
+
+	// Allocate the container's spartan IPs.
+	ipamResult, err := conf.ipamAdd(args, spartanNetConf)
 	if err != nil {
-		return Error(fmt.Sprintf("failed to get IP address:%s", err))
+		return nil, cnierrors.IPAM(err, "failed to get IP address")
 	}
 
 	result, err := current.NewResultFromResult(ipamResult)
 	if err != nil {
-		return Error(fmt.Sprintf("unable to parse IPAM result:%s", err))
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIPAMFailure, "unable to parse IPAM result")
 	}
 
 	if result.IPs == nil {
-		return Error("IPAM plugin returned missing IPv4 config")
+		return nil, cnierrors.New(cnierrors.ErrIPAMFailure, "IPAM plugin returned missing IPv4 config", "")
+	}
+
+	// Make sure we got a single IPv4 address, and at most one IPv6
+	// address.
+	var ipv4, ipv6 int
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.To4() != nil {
+			ipv4++
+		} else {
+			ipv6++
+		}
 	}
 
-	// Make sure we got only one IP and that it is IPv4
 	switch {
-	case len(result.IPs) > 1:
-		return Error("Expecting a single IPv4 address from IPAM")
-	case result.IPs[0].Address.IP.To4() == nil:
-		return Error("Expecting a IPv4 address from IPAM")
+	case ipv4 != 1:
+		return nil, cnierrors.New(cnierrors.ErrIPAMFailure, "Expecting a single IPv4 address from IPAM", "")
+	case ipv6 > 1:
+		return nil, cnierrors.New(cnierrors.ErrIPAMFailure, "Expecting at most one IPv6 address from IPAM", "")
 	}
 
-	hostVethName, err := setupContainerVeth(args.Netns, Config.Interface, 0, *result, IPs)
+	mtu, err = conf.vethMTU(args, mtu)
 	if err != nil {
-		return Error(fmt.Sprintf("unable to create veth pair: %s", err))
+		return nil, err
 	}
 
-	hostVeth, err := netlink.LinkByName(hostVethName)
+	log.Printf("Setting up spartan interface with MTU %d", mtu)
+
+	hostIface, containerIface, err := setupContainerVeth(args.Netns, conf.Interface, hostVethName, mtu, *result, conf.Nameservers())
 	if err != nil {
-		return Error(fmt.Sprintf("failed to lookup host VETH %s: %s", hostVethName, err))
+		return nil, cnierrors.Netns(err, fmt.Sprintf("unable to configure spartan interface in netns(%s)", args.Netns))
 	}
 
-	containerRoute := netlink.Route{
-		LinkIndex: hostVeth.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   result.IPs[0].Address.IP,
-			Mask: ipNetMask_32,
-		},
-		Scope: netlink.SCOPE_LINK,
+	hostVeth, err := netlink.LinkByName(hostIface.Name)
+	if err != nil {
+		return nil, cnierrors.Link(err, fmt.Sprintf("failed to lookup host VETH %s", hostIface.Name))
 	}
 
-	if err = netlink.RouteAdd(&containerRoute); err != nil {
-		return Error(fmt.Sprintf("failed to add spartan route %s: %s", containerRoute, err))
+	// Record which network and container the host veth belongs to, for
+	// GC and for operators looking at the host's interfaces.
+	if err = netlink.LinkSetAlias(hostVeth, vethAlias(network, args.ContainerID)); err != nil {
+		return nil, cnierrors.Link(err, fmt.Sprintf("failed to set alias of host VETH %s", hostIface.Name))
 	}
 
-	return nil
+	containerMac, err := net.ParseMAC(containerIface.Mac)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrInterfaceFailure, fmt.Sprintf("invalid MAC address of container VETH %s", containerIface.Mac))
+	}
+
+	for _, ipc := range result.IPs {
+		containerRoute := netlink.Route{
+			LinkIndex: hostVeth.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   ipc.Address.IP,
+				Mask: hostMask(ipc.Address.IP),
+			},
+			Scope: netlink.SCOPE_LINK,
+		}
+
+		if err = netlink.RouteAdd(&containerRoute); err != nil {
+			return nil, cnierrors.Link(err, fmt.Sprintf("failed to add spartan route %s", containerRoute))
+		}
+
+		// Don't wait for the link-local address of the host veth to
+		// come up to resolve the IPv6 address of the container.
+		if ipc.Address.IP.To4() == nil {
+			neigh := &netlink.Neigh{
+				LinkIndex:    hostVeth.Attrs().Index,
+				Family:       netlink.FAMILY_V6,
+				State:        netlink.NUD_PERMANENT,
+				IP:           ipc.Address.IP,
+				HardwareAddr: containerMac,
+			}
+
+			if err = netlink.NeighAdd(neigh); err != nil {
+				return nil, cnierrors.Link(err, fmt.Sprintf("failed to add neighbour entry for %s", ipc.Address.IP))
+			}
+		}
+	}
+
+	// Containers that pick their own nameservers would otherwise bypass
+	// spartan.
+	if conf.DNAT.Enable {
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			return conf.setupDNAT()
+		})
+
+		if err != nil {
+			return nil, cnierrors.Netns(err, fmt.Sprintf("unable to redirect DNS queries to spartan in netns(%s)", args.Netns))
+		}
+	}
+
+	// A broken spartan setup on the host would otherwise only show up as
+	// DNS timeouts once the container is running.
+	if conf.Probe.Policy != "" {
+		if err := conf.ProbeNameservers(args.Netns); err != nil {
+			if conf.Probe.Policy == ProbeFail {
+				return nil, err
+			}
+
+			log.Printf("WARNING: %s", err)
+		}
+	}
+
+	// The container end of the veth is the second interface in the
+	// result, and carries the /32 (and /128) set up by
+	// `setupContainerVeth`.
+	result.Interfaces = []*current.Interface{hostIface, containerIface}
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(1)
+		ipc.Gateway = nil
+	}
+	result.Routes = nil
+	for _, spartanIP := range conf.Nameservers() {
+		result.Routes = append(result.Routes, &types.Route{Dst: spartanIP})
+	}
+	result.DNS = types.DNS{}
+
+	return result, nil
 }
 
-func CniDel(args *skel.CmdArgs) error {
-	spartanNetConf, err := json.Marshal(Config)
+// CniDel detaches the container from the spartan network on behalf of the
+// dcos-l4lb `network`.
+func CniDel(args *skel.CmdArgs, conf *NetConf, network string) error {
+	// DEL has to undo what ADD set up for the spartan IPs it discovered,
+	// such as DNS redirection for their address families. The host
+	// interface might be gone by now, which must not keep DEL from
+	// cleaning up the rest.
+	if err := conf.DiscoverIPs(); err != nil {
+		log.Printf("WARNING: %s", err)
+	}
+
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	spartanNetConf, err := conf.ipamNetConf(args)
 	if err != nil {
-		return Error(fmt.Sprintf("failed to marshall the `spartan-network` IPAM configuration: %s", err))
+		return err
 	}
 
-	if err = ipam.ExecDel(Config.IPAM.Type, spartanNetConf); err != nil {
-		return Error(fmt.Sprintf("IPAM unable to invoke DEL:%s", err))
+	if err = conf.ipamDel(args, spartanNetConf); err != nil {
+		return cnierrors.IPAM(err, "IPAM unable to invoke DEL")
+	}
+
+	log.Println("Released spartan IP address for containerID", args.ContainerID)
+
+	if _, err := conf.Owners().Delete(args.ContainerID); err != nil {
+		return cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to remove the owner of the spartan leases")
 	}
 
 	if args.Netns == "" {
-		return nil
+		log.Println("No netns for containerID", args.ContainerID, ", skipping removal of spartan interface")
+	} else {
+		// Ideally, the kernel would clean up the veth and routes within
+		// the network namespace when the namespace is destroyed. We are
+		// still explicitly deleting the interface here since we don't
+		// want to the delegate plugin to see any interfaces during
+		// delete that it does not expect.
+		removed, err := tearDownContainerVeth(args.Netns, conf.Interface)
+		switch {
+		case err != nil:
+			log.Printf("failed to delete spartan interface in container: %s", err)
+		case removed:
+			log.Println("Removed spartan interface ", conf.Interface)
+		default:
+			log.Println("No spartan interface left in netns", args.Netns)
+		}
+
+		if conf.DNAT.Enable {
+			if err := conf.tearDownDNAT(args.Netns); err != nil {
+				log.Printf("failed to remove DNS redirection in container: %s", err)
+			}
+		}
 	}
 
-	// Ideally, the kernel would clean up the veth and routes within the
-	// network namespace when the namespace is destroyed. We are still
-	// explicitly deleting the interface here since we don't want to the
-	// delegate plugin to see any interfaces during delete that it does
-	// not expect.
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		// We just need to delete the interface, the associated routes
-		// will get deleted by themselves.
-		_, err := ip.DelLinkByNameAddr(Config.Interface, netlink.FAMILY_V4)
+	// The host end of the veth outlives the container's network
+	// namespace path if something else keeps the namespace around.
+	hostVethName := HostVethName(args.ContainerID, args.IfName)
+	removed, err := tearDownHostVeth(hostVethName, network, args.ContainerID)
+	switch {
+	case err != nil:
+		log.Printf("failed to delete spartan host interface: %s", err)
+	case removed:
+		log.Println("Removed spartan host interface", hostVethName)
+	}
+
+	return conf.RemoveResolvConf(args.ContainerID)
+}
+
+func CniCheck(args *skel.CmdArgs, conf *NetConf) error {
+	if err := conf.DiscoverIPs(); err != nil {
+		return err
+	}
+
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+		containerVeth, err := netlink.LinkByName(conf.Interface)
 		if err != nil {
-			return err
+			return cnierrors.Link(err, fmt.Sprintf("failed to lookup container VETH %q", conf.Interface))
+		}
+
+		// The veth should carry a /32 (or /128) address allocated from
+		// each range set of the spartan network.
+		addrs, err := netlink.AddrList(containerVeth, netlink.FAMILY_ALL)
+		if err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to list addresses on %q", conf.Interface))
+		}
+
+		for _, rangeSet := range conf.rangeSets() {
+			found := false
+			for _, addr := range addrs {
+				for _, r := range rangeSet {
+					subnet := net.IPNet(r.Subnet)
+					if isHostMask(addr.Mask) && subnet.Contains(addr.IP) {
+						found = true
+					}
+				}
+			}
+
+			if !found {
+				subnet := net.IPNet(rangeSet[0].Subnet)
+				msg := fmt.Sprintf("%q is missing a host address from %s", conf.Interface, subnet.String())
+				return cnierrors.New(cnierrors.ErrInterfaceFailure, msg, "")
+			}
+		}
+
+		routes, err := netlink.RouteList(containerVeth, netlink.FAMILY_ALL)
+		if err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to list routes on %q", conf.Interface))
+		}
+
+		// Every spartan IP needs a route through the veth.
+		for _, spartanIP := range conf.Nameservers() {
+			found := false
+			for _, route := range routes {
+				if route.Dst != nil && route.Dst.String() == spartanIP.String() {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				msg := fmt.Sprintf("route to spartan IP %s via %q is missing", spartanIP.String(), conf.Interface)
+				return cnierrors.New(cnierrors.ErrInterfaceFailure, msg, "")
+			}
+		}
+
+		if conf.DNAT.Enable {
+			return conf.checkDNAT()
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		log.Printf("failed to delete spartan interface in container: %s", err)
+		return cnierrors.Netns(err, fmt.Sprintf("spartan interface check failed in netns(%s)", args.Netns))
 	}
 
 	return nil
 }
+
+// releaseStaleLeases removes the leases of the spartan network that are
+// held by the `stale` containers, and returns the addresses that are
+// still leased.
+func (conf *NetConf) releaseStaleLeases(stale map[string]string) (map[string]bool, error) {
+	leased := map[string]bool{}
+
+	dir := filepath.Join(conf.dataDir(), NetworkName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return leased, nil
+	}
+
+	// Hold the lock of the host-local store, so that we don't race with
+	// the IPAM plugin allocating or releasing addresses.
+	store, err := disk.New(NetworkName, conf.dataDir())
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to open the spartan lease store")
+	}
+	defer store.Close()
+
+	if err := store.Lock(); err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, "failed to lock the spartan lease store")
+	}
+	defer store.Unlock()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to list spartan leases in %s", dir))
+	}
+
+	for _, entry := range entries {
+		// Leases are files named after the address they hold, that
+		// contain the ID of the container holding the lease followed by
+		// the interface name.
+		addr := net.ParseIP(entry.Name())
+		if entry.IsDir() || addr == nil {
+			continue
+		}
+
+		lease := filepath.Join(dir, entry.Name())
+		data, err := ioutil.ReadFile(lease)
+		if err != nil {
+			return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to read spartan lease %s", lease))
+		}
+
+		containerID := strings.TrimSpace(strings.Split(string(data), disk.LineBreak)[0])
+		if _, ok := stale[containerID]; !ok {
+			leased[addr.String()] = true
+			continue
+		}
+
+		if err := os.Remove(lease); err != nil {
+			return nil, cnierrors.Wrap(err, cnierrors.ErrIOFailure, fmt.Sprintf("failed to release spartan lease %s", lease))
+		}
+
+		log.Printf("Released spartan IP %s held by stale containerID %s", addr, containerID)
+	}
+
+	return leased, nil
+}
+
+// releaseStaleIPAMLeases runs DEL of the IPAM plugin for each of the
+// `stale` containers, which is how the leases of IPAM plugins that keep
+// them elsewhere are released. Containers whose leases could not be
+// released are dropped from `stale`, so that their owner records are kept
+// for the next GC, and the first failure is returned.
+func (conf *NetConf) releaseStaleIPAMLeases(args *skel.CmdArgs, stale map[string]string) error {
+	if len(stale) == 0 {
+		return nil
+	}
+
+	spartanNetConf, err := conf.ipamNetConf(args)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for containerID, ifName := range stale {
+		if err := conf.ipamRelease(args, containerID, ifName, spartanNetConf); err != nil {
+			log.Printf("WARNING: failed to release the spartan IPs of stale containerID %s: %s", containerID, err)
+			delete(stale, containerID)
+			if firstErr == nil {
+				firstErr = cnierrors.IPAM(err, fmt.Sprintf("failed to release the spartan IPs of stale containerID %s", containerID))
+			}
+			continue
+		}
+
+		log.Println("Released spartan IP address for stale containerID", containerID)
+	}
+
+	return firstErr
+}
+
+// removeStaleVeths deletes the host end of the spartan veths of `network`
+// that don't belong to one of `hostVeths`, or that route to an address of
+// the spartan network that is not in `leased`, unless `leased` is nil.
+// These are left behind when the container end is gone without a DEL. The
+// veths of other networks are left alone.
+func (conf *NetConf) removeStaleVeths(network string, hostVeths, leased map[string]bool) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return cnierrors.Link(err, "failed to list host interfaces")
+	}
+
+	for _, link := range links {
+		if _, ok := link.(*netlink.Veth); !ok {
+			continue
+		}
+
+		if vethNetwork(link.Attrs().Alias) != network {
+			continue
+		}
+
+		name := link.Attrs().Name
+		if strings.HasPrefix(name, hostVethPrefix) && !hostVeths[name] {
+			if err := netlink.LinkDel(link); err != nil {
+				return cnierrors.Link(err, fmt.Sprintf("failed to delete stale spartan veth %q", name))
+			}
+
+			log.Printf("Removed stale spartan veth %s of %s", name, link.Attrs().Alias)
+			continue
+		}
+
+		if leased == nil {
+			continue
+		}
+
+		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return cnierrors.Link(err, fmt.Sprintf("failed to list routes on %q", link.Attrs().Name))
+		}
+
+		for _, route := range routes {
+			if route.Dst == nil || !isHostMask(route.Dst.Mask) || !conf.inNetwork(route.Dst.IP) {
+				continue
+			}
+
+			if leased[route.Dst.IP.String()] {
+				continue
+			}
+
+			if err := netlink.LinkDel(link); err != nil {
+				return cnierrors.Link(err, fmt.Sprintf("failed to delete stale spartan veth %q", link.Attrs().Name))
+			}
+
+			log.Printf("Removed stale spartan veth %s routing to %s", link.Attrs().Name, route.Dst.IP)
+			break
+		}
+	}
+
+	return nil
+}
+
+// removeStaleResolvConfs removes the resolv.conf files written for the
+// `stale` containers.
+func (conf *NetConf) removeStaleResolvConfs(stale map[string]string) error {
+	if conf.DNS.ResolvConfDir == "" {
+		return nil
+	}
+
+	for containerID := range stale {
+		if err := conf.RemoveResolvConf(containerID); err != nil {
+			return err
+		}
+
+		log.Println("Removed resolv.conf of stale containerID", containerID)
+	}
+
+	return nil
+}
+
+// CniGC releases the spartan leases that containers got on the dcos-l4lb
+// `network`, unless they are part of `attachments`, and removes their
+// host veths and resolv.conf files. The state of containers on other
+// networks, which share the spartan network, is left alone.
+func CniGC(args *skel.CmdArgs, conf *NetConf, network string, attachments []types.GCAttachment) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	containerIDs := map[string]bool{}
+	hostVeths := map[string]bool{}
+	for _, attachment := range attachments {
+		containerIDs[attachment.ContainerID] = true
+		hostVeths[HostVethName(attachment.ContainerID, attachment.IfName)] = true
+	}
+
+	stale, err := conf.staleContainers(network, containerIDs)
+	if err != nil {
+		return err
+	}
+
+	// Other IPAM plugins keep their leases elsewhere, and we would take
+	// every spartan veth to be routing to an address that isn't leased.
+	// They have to release the leases themselves.
+	var leased map[string]bool
+	var releaseErr error
+	if conf.leasesAuthoritative() {
+		leased, err = conf.releaseStaleLeases(stale)
+		if err != nil {
+			return err
+		}
+	} else {
+		releaseErr = conf.releaseStaleIPAMLeases(args, stale)
+	}
+
+	if err := conf.removeStaleVeths(network, hostVeths, leased); err != nil {
+		return err
+	}
+
+	if err := conf.removeStaleResolvConfs(stale); err != nil {
+		return err
+	}
+
+	// The owners go last, so that a failed GC can be retried.
+	if err := conf.removeOwners(stale); err != nil {
+		return err
+	}
+
+	return releaseErr
+}
+
+// CniStatus checks that the host interface carrying the spartan IPs,
+// `spartan` unless they are discovered from another interface, carries
+// all of them. Without them, containers on the spartan network can't
+// reach spartan. When ADD creates the host interface, it is not checked,
+// since it might only be created by the next ADD.
+func CniStatus(conf *NetConf) error {
+	if err := conf.DiscoverIPs(); err != nil {
+		return cnierrors.New(cnierrors.ErrLimitedConnectivity, "unable to discover the spartan IPs", err.Error())
+	}
+
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	if conf.HostInterface == HostInterfaceCreate {
+		return nil
+	}
+
+	return conf.checkHostInterface(cnierrors.ErrLimitedConnectivity)
+}
@@ -0,0 +1,117 @@
+package spartan
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+)
+
+// probeQuery returns a DNS query for the nameservers of the root zone,
+// which any nameserver answers one way or another.
+func probeQuery(id uint16) []byte {
+	return []byte{
+		byte(id >> 8), byte(id), // ID
+		0x01, 0x00, // Recursion desired
+		0x00, 0x01, // One question
+		0x00, 0x00, // No answers
+		0x00, 0x00, // No authority records
+		0x00, 0x00, // No additional records
+		0x00,       // The root zone
+		0x00, 0x02, // NS
+		0x00, 0x01, // IN
+	}
+}
+
+// awaitAnswer waits until `deadline` for the answer to the query `id`.
+// Any answer will do, since all we want to know is whether the
+// nameserver can be reached.
+func awaitAnswer(conn *net.UDPConn, id uint16, deadline time.Time) error {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		// Skip anything that isn't an answer to our query.
+		if n >= 12 && buf[0] == byte(id>>8) && buf[1] == byte(id) && buf[2]&0x80 != 0 {
+			return nil
+		}
+	}
+}
+
+// ProbeNameservers sends a DNS query to each spartan IP from the network
+// namespace `netns`, and reports the nameservers that don't answer
+// within the probe timeout.
+func (conf *NetConf) ProbeNameservers(netns string) error {
+	timeout := DefaultProbeTimeout
+	if conf.Probe.Timeout > 0 {
+		timeout = time.Duration(conf.Probe.Timeout) * time.Millisecond
+	}
+
+	var unreachable []string
+	conns := map[string]*net.UDPConn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	// The sockets have to be created in the container's network
+	// namespace, but they stay there once created, so we can wait for
+	// the answers from here. Send all queries first, so that the probe
+	// takes no longer than the timeout however many nameservers there
+	// are.
+	id := uint16(os.Getpid())
+	err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		for _, spartanIP := range conf.IPs {
+			conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: spartanIP, Port: 53})
+			if err != nil {
+				unreachable = append(unreachable, fmt.Sprintf("%s (%s)", spartanIP, err))
+				continue
+			}
+
+			conns[spartanIP.String()] = conn
+			if _, err := conn.Write(probeQuery(id)); err != nil {
+				unreachable = append(unreachable, fmt.Sprintf("%s (%s)", spartanIP, err))
+				delete(conns, spartanIP.String())
+				conn.Close()
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return cnierrors.Netns(err, fmt.Sprintf("unable to probe the spartan nameservers from netns(%s)", netns))
+	}
+
+	deadline := time.Now().Add(timeout)
+	for _, spartanIP := range conf.IPs {
+		conn, ok := conns[spartanIP.String()]
+		if !ok {
+			continue
+		}
+
+		if err := awaitAnswer(conn, id, deadline); err != nil {
+			unreachable = append(unreachable, fmt.Sprintf("%s (%s)", spartanIP, err))
+		}
+	}
+
+	if len(unreachable) > 0 {
+		msg := fmt.Sprintf("spartan nameservers unreachable from netns(%s)", netns)
+		return cnierrors.New(cnierrors.ErrNameserverUnreachable, msg, strings.Join(unreachable, ", "))
+	}
+
+	return nil
+}
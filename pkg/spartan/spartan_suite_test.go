@@ -0,0 +1,13 @@
+package spartan_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSpartan(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spartan Suite")
+}
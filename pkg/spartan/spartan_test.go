@@ -0,0 +1,618 @@
+package spartan_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/dcos/dcos-cni/pkg/cnierrors"
+	"github.com/dcos/dcos-cni/pkg/spartan"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Spartan", func() {
+	Describe("Overriding DNS", func() {
+		var (
+			delegateDNS types.DNS
+			spartanIPs  []string
+		)
+
+		BeforeEach(func() {
+			delegateDNS = types.DNS{
+				Nameservers: []string{"10.0.0.2", "198.51.100.1"},
+				Domain:      "example.com",
+				Search:      []string{"example.com"},
+				Options:     []string{"ndots:5"},
+			}
+
+			spartanIPs = nil
+			for _, spartanIP := range spartan.IPs {
+				spartanIPs = append(spartanIPs, spartanIP.IP.String())
+			}
+		})
+
+		Context("With the default configuration", func() {
+			It("Replaces the nameservers with the spartan IPs", func() {
+				conf := spartan.NewNetConf()
+				dns := conf.OverrideDNS(delegateDNS)
+				Expect(dns.Nameservers).To(Equal(spartanIPs))
+				Expect(dns.Domain).To(Equal(delegateDNS.Domain))
+				Expect(dns.Search).To(Equal(delegateDNS.Search))
+				Expect(dns.Options).To(Equal(delegateDNS.Options))
+			})
+		})
+
+		Context("With fallback enabled", func() {
+			It("Keeps the delegate nameservers after the spartan IPs", func() {
+				conf := spartan.NewNetConf()
+				conf.DNS.Fallback = true
+				dns := conf.OverrideDNS(delegateDNS)
+				Expect(dns.Nameservers).To(Equal(append(spartanIPs, "10.0.0.2")))
+			})
+		})
+
+		Context("With search domains and options", func() {
+			It("Replaces the delegate search domains and options", func() {
+				conf := spartan.NewNetConf()
+				conf.DNS = spartan.DNSConf{
+					Search:  []string{"marathon.l4lb.thisdcos.directory"},
+					Options: []string{"ndots:2", "timeout:1"},
+				}
+				dns := conf.OverrideDNS(delegateDNS)
+				Expect(dns.Search).To(Equal([]string{"marathon.l4lb.thisdcos.directory"}))
+				Expect(dns.Options).To(Equal([]string{"ndots:2", "timeout:1"}))
+			})
+		})
+
+		Context("With a fallback nameserver", func() {
+			It("Lists it after the spartan IPs", func() {
+				conf := spartan.NewNetConf()
+				conf.DNS.FallbackNameserver = net.ParseIP("10.0.0.53")
+				conf.DNS.Fallback = true
+				dns := conf.OverrideDNS(delegateDNS)
+				Expect(dns.Nameservers).To(Equal(append(spartanIPs, "10.0.0.53", "10.0.0.2")))
+			})
+		})
+	})
+
+	Describe("Writing resolv.conf files", func() {
+		var (
+			conf *spartan.NetConf
+			dir  string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "resolv")
+			Expect(err).NotTo(HaveOccurred())
+
+			conf = spartan.NewNetConf()
+			conf.DNS.ResolvConfDir = dir
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("Writes a resolv.conf pointing at spartan", func() {
+			conf.DNS.FallbackNameserver = net.ParseIP("10.0.0.53")
+			conf.DNS.Search = []string{"marathon.l4lb.thisdcos.directory"}
+			conf.DNS.Options = []string{"ndots:2"}
+			dns := conf.OverrideDNS(types.DNS{Domain: "example.com"})
+
+			path, err := conf.WriteResolvConf("test", dns)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(filepath.Join(dir, "test", "resolv.conf")))
+			Expect(path).To(Equal(conf.ResolvConfPath("test")))
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("# Generated by the dcos-l4lb CNI plugin for container test\n" +
+				"nameserver 198.51.100.1\n" +
+				"nameserver 198.51.100.2\n" +
+				"nameserver 198.51.100.3\n" +
+				"nameserver 198.51.100.4\n" +
+				"nameserver 10.0.0.53\n" +
+				"search marathon.l4lb.thisdcos.directory\n" +
+				"options ndots:2\n"))
+		})
+
+		It("Falls back to the domain without search domains", func() {
+			path, err := conf.WriteResolvConf("test", types.DNS{Nameservers: []string{"198.51.100.1"}, Domain: "example.com"})
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(HaveSuffix("nameserver 198.51.100.1\ndomain example.com\n"))
+		})
+
+		It("Does nothing unless enabled", func() {
+			conf.DNS.ResolvConfDir = ""
+
+			path, err := conf.WriteResolvConf("test", conf.OverrideDNS(types.DNS{}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(BeEmpty())
+			Expect(conf.RemoveResolvConf("test")).To(Succeed())
+		})
+
+		It("Removes the resolv.conf of a container", func() {
+			path, err := conf.WriteResolvConf("test", conf.OverrideDNS(types.DNS{}))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(conf.RemoveResolvConf("test")).To(Succeed())
+			Expect(filepath.Dir(path)).NotTo(BeADirectory())
+			Expect(dir).To(BeADirectory())
+
+			// Removing it again is not an error.
+			Expect(conf.RemoveResolvConf("test")).To(Succeed())
+		})
+
+		It("Garbage collects the resolv.conf of unknown containers on the network", func() {
+			conf.IPAM.DataDir = dir
+
+			networks := map[string]string{"live": "dcos", "stale": "dcos", "other": "other"}
+			for containerID, network := range networks {
+				Expect(conf.Owners().Put(containerID, []byte(network))).To(Succeed())
+				_, err := conf.WriteResolvConf(containerID, conf.OverrideDNS(types.DNS{}))
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			args := &skel.CmdArgs{StdinData: []byte(`{"cniVersion": "1.1.0"}`)}
+			Expect(spartan.CniGC(args, conf, "dcos", []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}})).To(Succeed())
+			Expect(conf.ResolvConfPath("live")).To(BeAnExistingFile())
+			Expect(conf.ResolvConfPath("stale")).NotTo(BeAnExistingFile())
+			Expect(conf.ResolvConfPath("other")).To(BeAnExistingFile())
+		})
+	})
+
+	Describe("Garbage collection", func() {
+		var (
+			conf     *spartan.NetConf
+			args     *skel.CmdArgs
+			dataDir  string
+			leaseDir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "spartan")
+			Expect(err).NotTo(HaveOccurred())
+
+			conf = spartan.NewNetConf()
+			conf.IPAM.DataDir = dataDir
+			leaseDir = filepath.Join(dataDir, spartan.NetworkName)
+			Expect(os.MkdirAll(leaseDir, 0755)).To(Succeed())
+
+			args = &skel.CmdArgs{
+				StdinData: []byte(`{"cniVersion": "1.1.0"}`),
+				Path:      dataDir,
+			}
+
+			leases := map[string]string{
+				"198.51.100.10":      "live\r\neth0",
+				"198.51.100.11":      "stale\r\neth0",
+				"198.51.100.12":      "legacy",
+				"198.51.100.13":      "other\r\neth0",
+				"last_reserved_ip.0": "198.51.100.13",
+			}
+			for name, content := range leases {
+				Expect(ioutil.WriteFile(filepath.Join(leaseDir, name), []byte(content), 0644)).To(Succeed())
+			}
+
+			// The legacy lease predates owner records.
+			networks := map[string]string{"live": "dcos", "stale": "dcos", "other": "other"}
+			for containerID, network := range networks {
+				Expect(conf.Owners().Put(containerID, []byte(network+"\r\neth0"))).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dataDir)).To(Succeed())
+		})
+
+		It("Releases the leases of unknown containers on the network", func() {
+			err := spartan.CniGC(args, conf, "dcos", []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(filepath.Join(leaseDir, "198.51.100.10")).To(BeAnExistingFile())
+			Expect(filepath.Join(leaseDir, "198.51.100.11")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(leaseDir, "last_reserved_ip.0")).To(BeAnExistingFile())
+
+			_, err = conf.Owners().Get("stale")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Leaves the leases of other networks alone", func() {
+			Expect(spartan.CniGC(args, conf, "dcos", nil)).To(Succeed())
+			Expect(spartan.CniGC(args, conf, "unused", nil)).To(Succeed())
+
+			Expect(filepath.Join(leaseDir, "198.51.100.12")).To(BeAnExistingFile())
+			Expect(filepath.Join(leaseDir, "198.51.100.13")).To(BeAnExistingFile())
+
+			record, err := conf.Owners().Get("other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(record.Data)).To(Equal("other\r\neth0"))
+		})
+
+		It("Has another IPAM plugin release the leases of unknown containers", func() {
+			// The plugin logs the containers it is asked to release.
+			plugin := filepath.Join(dataDir, "fake-ipam")
+			script := "#!/bin/sh\necho \"$CNI_COMMAND $CNI_CONTAINERID $CNI_IFNAME\" >> $0.log\n"
+			Expect(ioutil.WriteFile(plugin, []byte(script), 0755)).To(Succeed())
+
+			conf.IPAM.Type = "fake-ipam"
+			err := spartan.CniGC(args, conf, "dcos", []types.GCAttachment{{ContainerID: "live", IfName: "eth0"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			released, err := ioutil.ReadFile(plugin + ".log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(released)).To(Equal("DEL stale eth0\n"))
+
+			// The plugin keeps its leases elsewhere.
+			Expect(filepath.Join(leaseDir, "198.51.100.11")).To(BeAnExistingFile())
+
+			_, err = conf.Owners().Get("stale")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Keeps the owners of leases that another IPAM plugin failed to release", func() {
+			conf.IPAM.Type = "missing-ipam"
+			Expect(spartan.CniGC(args, conf, "dcos", nil)).NotTo(Succeed())
+
+			_, err := conf.Owners().Get("stale")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Does nothing without a lease store", func() {
+			Expect(os.RemoveAll(leaseDir)).To(Succeed())
+			Expect(spartan.CniGC(args, conf, "dcos", nil)).To(Succeed())
+			Expect(leaseDir).NotTo(BeADirectory())
+		})
+	})
+
+	Describe("Allocating spartan IPs", func() {
+		var (
+			conf     *spartan.NetConf
+			dataDir  string
+			leaseDir string
+		)
+
+		args := func(containerID string) *skel.CmdArgs {
+			return &skel.CmdArgs{ContainerID: containerID, IfName: "eth0"}
+		}
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "spartan")
+			Expect(err).NotTo(HaveOccurred())
+
+			conf = spartan.NewNetConf()
+			conf.IPAM.Type = spartan.BuiltinIPAM
+			conf.IPAM.DataDir = dataDir
+			leaseDir = filepath.Join(dataDir, spartan.NetworkName)
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dataDir)).To(Succeed())
+		})
+
+		It("Leases addresses in the host-local format", func() {
+			result, err := conf.Allocate(args("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("198.51.100.10/24"))
+
+			result, err = conf.Allocate(args("second"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("198.51.100.11/24"))
+
+			entries, err := ioutil.ReadDir(leaseDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			Expect(names).To(ConsistOf("198.51.100.10", "198.51.100.11", "last_reserved_ip.0", "lock"))
+
+			data, err := ioutil.ReadFile(filepath.Join(leaseDir, "198.51.100.10"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("first\r\neth0"))
+
+			data, err = ioutil.ReadFile(filepath.Join(leaseDir, "last_reserved_ip.0"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal("198.51.100.11"))
+		})
+
+		It("Skips addresses leased by the host-local IPAM plugin", func() {
+			Expect(os.MkdirAll(leaseDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(leaseDir, "198.51.100.10"), []byte("other\r\neth0"), 0644)).To(Succeed())
+
+			result, err := conf.Allocate(args("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Address.IP.String()).To(Equal("198.51.100.11"))
+		})
+
+		It("Refuses a second lease for the same container", func() {
+			_, err := conf.Allocate(args("first"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = conf.Allocate(args("first"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Releases the leases of a container", func() {
+			_, err := conf.Allocate(args("first"))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(conf.Release(args("first"))).To(Succeed())
+			Expect(filepath.Join(leaseDir, "198.51.100.10")).NotTo(BeAnExistingFile())
+
+			// Releasing is idempotent.
+			Expect(conf.Release(args("first"))).To(Succeed())
+		})
+
+		It("Leases an address from each range set", func() {
+			conf.IPAM.Ranges = [][]spartan.Range{{{
+				Subnet: types.IPNet{
+					IP:   net.ParseIP("fd01:c51::"),
+					Mask: net.CIDRMask(64, 128),
+				},
+				RangeStart: net.ParseIP("fd01:c51::10"),
+				RangeEnd:   net.ParseIP("fd01:c51::ff"),
+			}}}
+
+			result, err := conf.Allocate(args("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(result.IPs[0].Address.IP.String()).To(Equal("198.51.100.10"))
+			Expect(result.IPs[1].Address.IP.String()).To(Equal("fd01:c51::10"))
+			Expect(filepath.Join(leaseDir, "last_reserved_ip.1")).To(BeAnExistingFile())
+		})
+
+		It("Reports an exhausted range and keeps no partial leases", func() {
+			conf.IPAM.Ranges = [][]spartan.Range{{{
+				Subnet: types.IPNet{
+					IP:   net.ParseIP("fd01:c51::"),
+					Mask: net.CIDRMask(64, 128),
+				},
+				RangeStart: net.ParseIP("fd01:c51::10"),
+				RangeEnd:   net.ParseIP("fd01:c51::10"),
+			}}}
+
+			_, err := conf.Allocate(args("first"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = conf.Allocate(args("second"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*types.Error).Code).To(Equal(cnierrors.ErrIPAMExhausted))
+
+			// The IPv4 address leased before running out of IPv6
+			// addresses has been released.
+			Expect(filepath.Join(leaseDir, "198.51.100.11")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("Validating the configuration", func() {
+		var conf *spartan.NetConf
+
+		BeforeEach(func() {
+			conf = spartan.NewNetConf()
+		})
+
+		expectInvalid := func() {
+			err := conf.Validate()
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(cnierrors.ErrInvalidConfig))
+		}
+
+		It("Accepts the defaults", func() {
+			Expect(conf.Validate()).To(Succeed())
+		})
+
+		It("Accepts a custom network", func() {
+			err := json.Unmarshal([]byte(`{
+				"ips": ["10.10.0.1", "10.10.0.2"],
+				"interface": "dns0",
+				"ipam": {
+					"subnet": "10.10.0.0/16",
+					"rangeStart": "10.10.1.0",
+					"rangeEnd": "10.10.255.254"
+				}
+			}`), conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Validate()).To(Succeed())
+
+			Expect(conf.IPAM.Type).To(Equal("host-local"))
+			Expect(conf.Nameservers()).To(HaveLen(2))
+			Expect(conf.Nameservers()[0].String()).To(Equal("10.10.0.1/32"))
+		})
+
+		It("Doesn't carry the default range over to a custom subnet", func() {
+			err := json.Unmarshal([]byte(`{
+				"ips": ["10.20.0.1"],
+				"ipam": { "subnet": "10.10.0.0/24", "rangeStart": "10.10.0.10" }
+			}`), conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Validate()).To(Succeed())
+
+			Expect(conf.IPAM.RangeStart.String()).To(Equal("10.10.0.10"))
+			Expect(conf.IPAM.RangeEnd).To(BeNil())
+		})
+
+		It("Keeps the default subnet when only the range is set", func() {
+			err := json.Unmarshal([]byte(`{
+				"ipam": { "rangeStart": "198.51.100.100" }
+			}`), conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Validate()).To(Succeed())
+
+			Expect(conf.IPAM.Subnet.IP.String()).To(Equal("198.51.100.0"))
+			Expect(conf.IPAM.RangeEnd.String()).To(Equal("198.51.100.253"))
+		})
+
+		It("Rejects a network without nameservers", func() {
+			conf.IPs = nil
+			expectInvalid()
+		})
+
+		It("Accepts a network discovering its nameservers", func() {
+			conf.IPs = nil
+			conf.Discover = spartan.IfName
+			Expect(conf.Validate()).To(Succeed())
+		})
+
+		It("Rejects an invalid interface name", func() {
+			conf.Interface = "a-very-long-interface-name"
+			expectInvalid()
+		})
+
+		It("Rejects a range outside of the subnet", func() {
+			conf.IPAM.RangeEnd = net.ParseIP("198.51.101.10")
+			expectInvalid()
+		})
+
+		It("Rejects a range that ends before it starts", func() {
+			conf.IPAM.RangeStart, conf.IPAM.RangeEnd = conf.IPAM.RangeEnd, conf.IPAM.RangeStart
+			expectInvalid()
+		})
+
+		It("Rejects nameservers within the range", func() {
+			conf.IPs = append(conf.IPs, net.ParseIP("198.51.100.20"))
+			expectInvalid()
+		})
+
+		It("Rejects a relative resolv.conf directory", func() {
+			conf.DNS.ResolvConfDir = "resolv"
+			expectInvalid()
+		})
+
+		It("Rejects an unknown host interface mode", func() {
+			conf.HostInterface = "replace"
+			expectInvalid()
+		})
+
+		It("Rejects creating the host interface of discovered IPs", func() {
+			conf.Discover = spartan.IfName
+			conf.HostInterface = spartan.HostInterfaceCreate
+			expectInvalid()
+		})
+
+		It("Rejects an unknown probe policy", func() {
+			conf.Probe.Policy = "retry"
+			expectInvalid()
+		})
+
+		It("Rejects a negative probe timeout", func() {
+			conf.Probe = spartan.ProbeConf{Policy: spartan.ProbeWarn, Timeout: -1}
+			expectInvalid()
+		})
+
+		It("Accepts DNS redirection exemptions", func() {
+			err := json.Unmarshal([]byte(`{
+				"dnat": {
+					"enable": true,
+					"exempt": ["10.0.0.0/8", "fd00::/8"]
+				}
+			}`), conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conf.Validate()).To(Succeed())
+			Expect(conf.DNAT.Exempt).To(HaveLen(2))
+		})
+
+		It("Rejects a DNS redirection exemption without a subnet", func() {
+			conf.DNAT = spartan.DNATConf{Enable: true, Exempt: []types.IPNet{{}}}
+			expectInvalid()
+		})
+
+		It("Rejects a network without an IPAM plugin", func() {
+			conf.IPAM.Type = ""
+			expectInvalid()
+		})
+
+		Context("With an IPv6 range set", func() {
+			BeforeEach(func() {
+				err := json.Unmarshal([]byte(`{
+					"ips": ["198.51.100.1", "fd00:5::1"],
+					"ipam": {
+						"ranges": [[{ "subnet": "fd00:5::/64", "rangeStart": "fd00:5::10" }]]
+					}
+				}`), conf)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("Accepts a dual-stack network", func() {
+				Expect(conf.Validate()).To(Succeed())
+
+				var nameservers []string
+				for _, nameserver := range conf.Nameservers() {
+					nameservers = append(nameservers, nameserver.String())
+				}
+				Expect(nameservers).To(Equal([]string{"198.51.100.1/32", "fd00:5::1/128"}))
+			})
+
+			It("Rejects IPv6 nameservers within the range", func() {
+				conf.IPs = append(conf.IPs, net.ParseIP("fd00:5::20"))
+				expectInvalid()
+			})
+
+			It("Rejects a second range set of the same family", func() {
+				conf.IPAM.Ranges = append(conf.IPAM.Ranges, conf.IPAM.Ranges[0])
+				expectInvalid()
+			})
+
+			It("Rejects a range outside of its subnet", func() {
+				conf.IPAM.Ranges[0][0].RangeEnd = net.ParseIP("fd00:6::10")
+				expectInvalid()
+			})
+		})
+
+		It("Rejects IPv6 nameservers without an IPv6 range set", func() {
+			conf.IPs = append(conf.IPs, net.ParseIP("fd00:5::1"))
+			expectInvalid()
+		})
+	})
+
+	Describe("Discovering the spartan IPs", func() {
+		It("Keeps the configured IPs unless discovery is enabled", func() {
+			conf := spartan.NewNetConf()
+			Expect(conf.DiscoverIPs()).To(Succeed())
+			Expect(conf.Nameservers()).To(Equal(spartan.IPs))
+		})
+
+		It("Reports a missing host interface", func() {
+			conf := spartan.NewNetConf()
+			conf.Discover = "nonexistent0"
+
+			err := conf.DiscoverIPs()
+			Expect(err).To(HaveOccurred())
+
+			cniErr, ok := err.(*types.Error)
+			Expect(ok).To(BeTrue())
+			Expect(cniErr.Code).To(Equal(cnierrors.ErrInterfaceFailure))
+		})
+	})
+
+	Describe("Naming host veths", func() {
+		It("Derives a valid name from the container ID and interface name", func() {
+			name := spartan.HostVethName("a-rather-long-container-id", "eth0")
+			Expect(name).To(HavePrefix("spt"))
+			Expect(len(name)).To(BeNumerically("<=", 15))
+
+			Expect(spartan.HostVethName("a-rather-long-container-id", "eth0")).To(Equal(name))
+			Expect(spartan.HostVethName("a-rather-long-container-id", "eth1")).NotTo(Equal(name))
+			Expect(spartan.HostVethName("another-container-id", "eth0")).NotTo(Equal(name))
+		})
+	})
+})